@@ -33,11 +33,10 @@ type UserContextKeyType string
 var (
 	WG sync.WaitGroup
 
-	BaseAppiumPort = "4724"
-	AppDirs        AppDirectories
-	Adb            string
-	GoIOS          string
-	Appium         string
+	AppDirs AppDirectories
+	Adb     string
+	GoIOS   string
+	Appium  string
 
 	SanitisatioEndpoint = "https://prod-mobile-automation-artefects.lambdatest.com/byod-assets"
 
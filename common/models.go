@@ -1,5 +1,7 @@
 package common
 
+import "time"
+
 type ProcessInfo struct {
 	PID               int
 	Name              string
@@ -8,6 +10,61 @@ type ProcessInfo struct {
 	ForegroundRunning bool
 }
 
+// Transports connecting a device to the host.
+const (
+	TransportUSB     = "usb"
+	TransportNetwork = "network" // adb over TCP or wireless debugging
+)
+
+// DeviceInfo describes a device attached to the host.
+type DeviceInfo struct {
+	OS            string `json:"os"`
+	Name          string `json:"name"`
+	UDID          string `json:"udid"`
+	Brand         string `json:"brand"`
+	Model         string `json:"model"`
+	Status        string `json:"status"`
+	OSVersion     string `json:"os_version"`
+	FullOSVersion string `json:"full_os_version"`
+	Transport     string `json:"transport,omitempty"` // usb or network
+
+	State         DeviceState `json:"state"`
+	PreviousState DeviceState `json:"previous_state,omitempty"`
+	StateSince    time.Time   `json:"state_since"`
+	StateReason   string      `json:"state_reason,omitempty"`
+
+	LastSeen    time.Time    `json:"last_seen"`
+	Health      DeviceHealth `json:"health"`
+	HealthScore int          `json:"health_score"` // rolling success rate of sessions and installs, 0 to 100
+}
+
+// DeviceHealth holds the last health readings of a device.
+type DeviceHealth struct {
+	BatteryLevel       int       `json:"battery_level"`                 // percent
+	BatteryTemperature float64   `json:"battery_temperature,omitempty"` // celsius, Android only
+	Charging           bool      `json:"charging"`
+	StorageFree        int64     `json:"storage_free"`           // bytes available on the data partition
+	StorageTotal       int64     `json:"storage_total"`          // bytes of the data partition
+	Uptime             int64     `json:"uptime,omitempty"`       // seconds since boot, Android only
+	ScreenState        string    `json:"screen_state,omitempty"` // on, off or dozing, Android only
+	Warnings           []string  `json:"warnings,omitempty"`
+	CollectedAt        time.Time `json:"collected_at"`
+}
+
+// DeviceOptions are the per-device settings of the preparation run before every session.
+type DeviceOptions struct {
+	PIN         string `json:"pin,omitempty"` // screen lock PIN entered to unlock Android devices
+	StayAwake   bool   `json:"stayAwake"`     // keep the screen on while charging, Android only
+	SkipPrepare bool   `json:"skipPrepare"`   // start sessions without preparing the device
+}
+
+// AppInfo represents the structure for a single application.
+type AppInfo struct {
+	Name    string `json:"name"`
+	Package string `json:"package"`
+	Version string `json:"version"`
+}
+
 type TestInfo struct {
 	OS             string `json:"os"`
 	UDID           string `json:"udid"`
@@ -0,0 +1,78 @@
+package common
+
+import (
+	"fmt"
+	"time"
+)
+
+// DeviceState is a step of the device lifecycle.
+type DeviceState string
+
+const (
+	StateDetected    DeviceState = "detected"    // attached, not yet provisioned
+	StatePreparing   DeviceState = "preparing"   // reading properties, mounting disk images, installing WDA
+	StateReady       DeviceState = "ready"       // idle and able to start a session
+	StateInSession   DeviceState = "in_session"  // running a session
+	StateCleaning    DeviceState = "cleaning"    // restoring the device after a session
+	StateUnhealthy   DeviceState = "unhealthy"   // provisioning or cleanup failed, needs recovery
+	StateQuarantined DeviceState = "quarantined" // failing too often, waiting for a self-test to pass
+	StateOffline     DeviceState = "offline"     // detached or not answering
+)
+
+// deviceTransitions lists the states reachable from each state.
+var deviceTransitions = map[DeviceState][]DeviceState{
+	StateDetected:    {StatePreparing, StateUnhealthy, StateOffline},
+	StatePreparing:   {StateReady, StateUnhealthy, StateQuarantined, StateOffline},
+	StateReady:       {StateInSession, StatePreparing, StateUnhealthy, StateQuarantined, StateOffline},
+	StateInSession:   {StateCleaning, StateUnhealthy, StateOffline},
+	StateCleaning:    {StateReady, StateUnhealthy, StateQuarantined, StateOffline},
+	StateUnhealthy:   {StatePreparing, StateOffline},
+	StateQuarantined: {StatePreparing, StateOffline},
+	StateOffline:     {StateDetected, StatePreparing},
+}
+
+// CanTransition reports whether a device may move from one state to the other.
+func CanTransition(from, to DeviceState) bool {
+	for _, next := range deviceTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Valid reports whether the state is a known step of the device lifecycle.
+func (s DeviceState) Valid() bool {
+	_, ok := deviceTransitions[s]
+	return ok
+}
+
+// Schedulable reports whether sessions may be scheduled on a device in this state, possibly after a queue.
+func (s DeviceState) Schedulable() bool {
+	return s == StateReady || s == StateInSession || s == StateCleaning
+}
+
+// LegacyStatus returns the status string reported before device states existed.
+func (s DeviceState) LegacyStatus() string {
+	switch s {
+	case StateReady, StateInSession:
+		return "ready"
+	case StateOffline:
+		return "disconnected"
+	default:
+		return "connected"
+	}
+}
+
+// Transition moves the device to a new state, keeping the previous state, the reason and the time of the change.
+func (d *DeviceInfo) Transition(to DeviceState, reason string, at time.Time) error {
+	if d.State != "" && !CanTransition(d.State, to) {
+		return fmt.Errorf("device %s cannot go from %s to %s", d.UDID, d.State, to)
+	}
+	d.PreviousState = d.State
+	d.State = to
+	d.StateSince = at
+	d.StateReason = reason
+	d.Status = to.LegacyStatus()
+	return nil
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"byod/common"
+	"byod/quarantine"
 	"byod/remote"
 	"byod/services"
+	"byod/storage"
 	"byod/watcher"
 	"context"
 	"encoding/base64"
@@ -11,6 +13,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -34,6 +37,9 @@ func main() {
 
 	startDeviceWatcher(stopChan)                         // Start the device watcher to monitor device activities.
 	go services.ResetAuthenticatedJwtUsersCron(stopChan) //to reset jwt token map after 30 mins
+	go services.SessionReaperCron(stopChan)              //to end idle sessions and sessions of disconnected devices
+	go services.AppiumPoolCron(stopChan)                 //to keep warm appium servers on ready devices when enabled
+	go services.SelfTestCron(stopChan)                   //to readmit quarantined devices passing their self-test
 
 	services.StartServer() // Start the main server at end to handle incoming requests.
 
@@ -48,6 +54,17 @@ func parseFlags() (string, string) {
 
 	env := flag.String("env", "stage", "env: stage/prod, default 'prod'")
 	tunnel := flag.String("tunnel", "./LT", "LT Tunnel Binary Path, default './LT'")
+	capabilities := flag.String("capabilities", "", "JSON file with capability defaults and limits enforced on sessions")
+	cleanup := flag.String("cleanup", "", "JSON file with the cleanup profiles run on devices after every session")
+	idleTimeout := flag.Duration("session-idle-timeout", 30*time.Minute, "end sessions without commands for this long, default 30m")
+	warmAppium := flag.Bool("warm-appium", false, "keep a warm appium server with its driver started on every ready device")
+	recycleAfter := flag.Int("appium-recycle-after", 50, "restart a warm appium server after this many sessions, default 50")
+	quarantineThreshold := flag.Int("quarantine-threshold", quarantine.DefaultThreshold, "quarantine devices whose health score drops below this value, 0 disables, default 50")
+	selfTest := flag.String("self-test", services.SelfTestProbe, "self-test readmitting quarantined devices: probe or session, default probe")
+	quarantineCooldown := flag.Duration("quarantine-cooldown", 10*time.Minute, "keep devices quarantined this long before their self-test, default 10m")
+	db := flag.String("db", "byod.db", "KV store file kept across restarts, default 'byod.db'")
+	networkDevices := flag.String("network-devices", "", "comma separated host:port of the Android devices kept connected over the network")
+	healthInterval := flag.Duration("health-interval", 2*time.Minute, "read battery, storage and screen state of every device this often, default 2m")
 
 	flag.Parse() // Parse all command-line flags.
 
@@ -56,7 +73,32 @@ func parseFlags() (string, string) {
 		flag.PrintDefaults() // Display default help messages for flags.
 		os.Exit(1)           // Exit the program with an error code.
 	}
+	storage.Init(*db)
 	remote.SetTunnelArgs(*tunnel, *env)
+	services.SetSessionIdleTimeout(*idleTimeout)
+	services.SetAppiumPool(*warmAppium, *recycleAfter)
+	watcher.SetHealthInterval(*healthInterval)
+	if err := watcher.SetNetworkDevices(strings.Split(*networkDevices, ",")); err != nil {
+		log.Println("Invalid network devices: ", err)
+		os.Exit(1)
+	}
+	quarantine.SetThreshold(*quarantineThreshold)
+	if err := services.SetSelfTest(*selfTest, *quarantineCooldown); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	if *capabilities != "" {
+		if err := services.LoadCapabilityPolicy(*capabilities); err != nil {
+			log.Println("Unable to load capability policy: ", err)
+			os.Exit(1)
+		}
+	}
+	if *cleanup != "" {
+		if err := services.LoadCleanupPolicy(*cleanup); err != nil {
+			log.Println("Unable to load cleanup policy: ", err)
+			os.Exit(1)
+		}
+	}
 	return *user, *key // Return the parsed username and key.
 }
 
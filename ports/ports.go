@@ -0,0 +1,292 @@
+package ports
+
+import (
+	"byod/common"
+	"byod/storage"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Kind identifies what a leased port is used for.
+type Kind string
+
+const (
+	Appium       Kind = "appium"       // appium server of the device
+	WDA          Kind = "wda"          // WebDriverAgent forwarded to the host
+	MJPEG        Kind = "mjpeg"        // MJPEG screen stream forwarded to the host
+	Chromedriver Kind = "chromedriver" // chromedriver for web and hybrid sessions
+	System       Kind = "system"       // UiAutomator2 server forwarded to the host
+)
+
+const (
+	leasesKey        = "Port_Leases"    // KV store key holding the persisted leases
+	conflictCooldown = 10 * time.Minute // time a port found bound by other software is not leased
+)
+
+// Range is an inclusive range of host ports.
+type Range struct {
+	Start, End int
+}
+
+// DefaultRanges are the host port ranges handed out per kind.
+var DefaultRanges = map[Kind]Range{
+	Appium:       {4724, 4999},
+	WDA:          {8100, 8199},
+	System:       {8200, 8299},
+	MJPEG:        {9100, 9199},
+	Chromedriver: {9515, 9614},
+}
+
+// Lease is the set of host ports reserved for one device.
+type Lease struct {
+	UDID     string
+	Ports    map[Kind]int
+	LeasedAt time.Time
+}
+
+// Port returns the leased port of the given kind as a string, empty if none.
+func (l Lease) Port(kind Kind) string {
+	if port, ok := l.Ports[kind]; ok {
+		return strconv.Itoa(port)
+	}
+	return ""
+}
+
+// Allocator hands out port leases per device. It is safe for concurrent use.
+type Allocator struct {
+	mu        sync.Mutex
+	ranges    map[Kind]Range
+	leases    map[string]Lease
+	owners    map[int]string    // port to UDID of the lease holding it
+	conflicts map[int]time.Time // ports bound by other software, skipped until the time
+	available func(port string) bool
+	persist   bool
+	loaded    bool
+}
+
+// Default is the allocator of the host, its leases are persisted in the KV store.
+var Default = &Allocator{ranges: DefaultRanges, available: common.IsPortAvailable, persist: true}
+
+// NewAllocator returns an allocator over the given ranges, checking ports with available.
+// Its leases are kept in memory only.
+func NewAllocator(ranges map[Kind]Range, available func(port string) bool) *Allocator {
+	return &Allocator{
+		ranges:    ranges,
+		leases:    make(map[string]Lease),
+		owners:    make(map[int]string),
+		conflicts: make(map[int]time.Time),
+		available: available,
+		loaded:    true,
+	}
+}
+
+// Acquire returns the lease of the device, reserving a free port of every kind if it has none.
+func (a *Allocator) Acquire(udid string) (Lease, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.load()
+
+	if lease, ok := a.leases[udid]; ok {
+		return lease, nil
+	}
+	lease := Lease{UDID: udid, Ports: make(map[Kind]int), LeasedAt: time.Now()}
+	for kind, r := range a.ranges {
+		port, err := a.free(r)
+		if err != nil {
+			for _, taken := range lease.Ports {
+				delete(a.owners, taken)
+			}
+			return Lease{}, fmt.Errorf("no free %s port for %s: %v", kind, udid, err)
+		}
+		lease.Ports[kind] = port
+		a.owners[port] = udid
+	}
+	a.leases[udid] = lease
+	a.save()
+	log.Printf("ports :: leased %v to %s\n", lease.Ports, udid)
+	return lease, nil
+}
+
+// Lookup returns the lease of the device.
+func (a *Allocator) Lookup(udid string) (Lease, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.load()
+	lease, ok := a.leases[udid]
+	return lease, ok
+}
+
+// Release returns the ports of the device to the pool.
+func (a *Allocator) Release(udid string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.load()
+
+	lease, ok := a.leases[udid]
+	if !ok {
+		return
+	}
+	for _, port := range lease.Ports {
+		delete(a.owners, port)
+	}
+	delete(a.leases, udid)
+	a.save()
+	log.Printf("ports :: released %v of %s\n", lease.Ports, udid)
+}
+
+// Retain drops the leases of the devices not in udids, which are not attached anymore.
+// Leases restored from the store are otherwise only released when their device detaches again.
+func (a *Allocator) Retain(udids []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.load()
+
+	keep := make(map[string]bool, len(udids))
+	for _, udid := range udids {
+		keep[udid] = true
+	}
+	dropped := false
+	for udid, lease := range a.leases {
+		if keep[udid] {
+			continue
+		}
+		for _, port := range lease.Ports {
+			delete(a.owners, port)
+		}
+		delete(a.leases, udid)
+		dropped = true
+		log.Printf("ports :: dropping lease %v of %s, device not attached\n", lease.Ports, udid)
+	}
+	if dropped {
+		a.save()
+	}
+}
+
+// Conflict replaces the port of the given kind in the lease of the device, another process being bound to it.
+// The port is not leased again for a while.
+func (a *Allocator) Conflict(udid string, kind Kind) (Lease, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.load()
+
+	lease, ok := a.leases[udid]
+	if !ok {
+		return Lease{}, fmt.Errorf("no ports leased to %s", udid)
+	}
+	busy := lease.Ports[kind]
+	a.conflicts[busy] = time.Now().Add(conflictCooldown)
+	port, err := a.free(a.ranges[kind])
+	if err != nil {
+		return lease, fmt.Errorf("no free %s port for %s: %v", kind, udid, err)
+	}
+	replaced := make(map[Kind]int, len(lease.Ports))
+	for k, p := range lease.Ports {
+		replaced[k] = p
+	}
+	replaced[kind] = port
+	lease.Ports = replaced
+	delete(a.owners, busy)
+	a.owners[port] = udid
+	a.leases[udid] = lease
+	a.save()
+	log.Printf("ports :: %s port %d of %s is used by another process, leased %d instead\n", kind, busy, udid, port)
+	return lease, nil
+}
+
+// free returns the first port of the range that is neither leased nor bound by another process.
+func (a *Allocator) free(r Range) (int, error) {
+	for port := r.Start; port <= r.End; port++ {
+		if _, leased := a.owners[port]; leased {
+			continue
+		}
+		if until, ok := a.conflicts[port]; ok && time.Now().Before(until) {
+			continue
+		}
+		if a.available(strconv.Itoa(port)) {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("range %d-%d exhausted", r.Start, r.End)
+}
+
+// load restores the persisted leases once, dropping the ones whose ports were taken by other software meanwhile.
+func (a *Allocator) load() {
+	if a.loaded {
+		return
+	}
+	a.loaded = true
+	a.leases = make(map[string]Lease)
+	a.owners = make(map[int]string)
+	a.conflicts = make(map[int]time.Time)
+	if !a.persist || storage.Store == nil {
+		return
+	}
+
+	var persisted map[string]Lease
+	if err := storage.Store.Get(leasesKey, &persisted); err != nil {
+		return
+	}
+	for udid, lease := range persisted {
+		if !a.reusable(lease) {
+			log.Printf("ports :: dropping stale lease of %s, ports are in use\n", udid)
+			continue
+		}
+		a.leases[udid] = lease
+		for _, port := range lease.Ports {
+			a.owners[port] = udid
+		}
+	}
+	a.save()
+}
+
+// reusable reports whether every port of a persisted lease is inside its range and free.
+func (a *Allocator) reusable(lease Lease) bool {
+	for kind, r := range a.ranges {
+		port, ok := lease.Ports[kind]
+		if !ok || port < r.Start || port > r.End {
+			return false
+		}
+		if _, leased := a.owners[port]; leased || !a.available(strconv.Itoa(port)) {
+			return false
+		}
+	}
+	return true
+}
+
+// save persists the leases in the KV store.
+func (a *Allocator) save() {
+	if !a.persist || storage.Store == nil {
+		return
+	}
+	if err := storage.Store.Put(leasesKey, a.leases); err != nil {
+		log.Println("ports :: unable to persist leases: ", err)
+	}
+}
+
+// Acquire returns the lease of the device from the default allocator.
+func Acquire(udid string) (Lease, error) {
+	return Default.Acquire(udid)
+}
+
+// Lookup returns the lease of the device from the default allocator.
+func Lookup(udid string) (Lease, bool) {
+	return Default.Lookup(udid)
+}
+
+// Conflict replaces a port of the device bound by another process in the default allocator.
+func Conflict(udid string, kind Kind) (Lease, error) {
+	return Default.Conflict(udid, kind)
+}
+
+// Retain drops the leases of the default allocator whose device is not in udids.
+func Retain(udids []string) {
+	Default.Retain(udids)
+}
+
+// Release returns the ports of the device to the default allocator.
+func Release(udid string) {
+	Default.Release(udid)
+}
@@ -0,0 +1,142 @@
+package ports
+
+import (
+	"byod/storage"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+var testRanges = map[Kind]Range{Appium: {4724, 4727}, WDA: {8100, 8103}}
+
+// bound simulates the ports bound by other software.
+type bound struct {
+	mu    sync.Mutex
+	ports map[string]bool
+}
+
+func (b *bound) set(port int, taken bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ports[strconv.Itoa(port)] = taken
+}
+
+func (b *bound) available(port string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.ports[port]
+}
+
+// persistentAllocator returns an allocator persisting its leases in the store, as Default does.
+func persistentAllocator(b *bound) *Allocator {
+	return &Allocator{ranges: testRanges, available: b.available, persist: true}
+}
+
+// useTempStore points the KV store to a database of the test.
+func useTempStore(t *testing.T) {
+	store, err := storage.Open(filepath.Join(t.TempDir(), "byod.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := storage.Store
+	storage.Store = store
+	t.Cleanup(func() {
+		storage.Store = previous
+		store.Close()
+	})
+}
+
+func TestAcquireLeasesDistinctPorts(t *testing.T) {
+	b := &bound{ports: map[string]bool{"4724": true}}
+	a := NewAllocator(testRanges, b.available)
+
+	first, err := a.Acquire("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Ports[Appium] != 4725 {
+		t.Errorf("leased appium port %d, want 4725 skipping the bound 4724", first.Ports[Appium])
+	}
+	if again, _ := a.Acquire("a"); again.Ports[Appium] != first.Ports[Appium] {
+		t.Error("second acquire changed the lease")
+	}
+	second, _ := a.Acquire("b")
+	if second.Ports[Appium] == first.Ports[Appium] || second.Ports[WDA] == first.Ports[WDA] {
+		t.Errorf("leases overlap %v %v", first.Ports, second.Ports)
+	}
+	a.Acquire("c")
+	if _, err := a.Acquire("d"); err == nil {
+		t.Error("lease granted from an exhausted range")
+	}
+	a.Release("b")
+	if _, err := a.Acquire("d"); err != nil {
+		t.Errorf("released ports not reused: %v", err)
+	}
+}
+
+func TestConflictReplacesBoundPort(t *testing.T) {
+	b := &bound{ports: map[string]bool{}}
+	a := NewAllocator(testRanges, b.available)
+	lease, _ := a.Acquire("a")
+	wda := lease.Ports[WDA]
+
+	b.set(lease.Ports[Appium], true)
+	replaced, err := a.Conflict("a", Appium)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced.Ports[Appium] == lease.Ports[Appium] || replaced.Ports[WDA] != wda {
+		t.Errorf("conflict lease %v, want a new appium port only, was %v", replaced.Ports, lease.Ports)
+	}
+	// the port stays skipped once the other process released it
+	b.set(lease.Ports[Appium], false)
+	if other, _ := a.Acquire("b"); other.Ports[Appium] == lease.Ports[Appium] {
+		t.Error("conflicting port leased again right away")
+	}
+	if _, err := a.Conflict("unknown", Appium); err == nil {
+		t.Error("conflict on a device without lease")
+	}
+}
+
+func TestLeasesSurviveRestart(t *testing.T) {
+	useTempStore(t)
+	b := &bound{ports: map[string]bool{}}
+	before := persistentAllocator(b)
+	kept, _ := before.Acquire("kept")
+	stale, _ := before.Acquire("stale")
+
+	// another process took a port of the stale lease while the binary was down
+	b.set(stale.Ports[WDA], true)
+	after := persistentAllocator(b)
+	if lease, ok := after.Lookup("kept"); !ok || lease.Ports[Appium] != kept.Ports[Appium] || lease.Ports[WDA] != kept.Ports[WDA] {
+		t.Errorf("lease not restored %v, want %v", lease.Ports, kept.Ports)
+	}
+	if _, ok := after.Lookup("stale"); ok {
+		t.Error("lease with a port bound by other software restored")
+	}
+}
+
+func TestRetainDropsLeasesOfDetachedDevices(t *testing.T) {
+	useTempStore(t)
+	b := &bound{ports: map[string]bool{}}
+	before := persistentAllocator(b)
+	attached, _ := before.Acquire("attached")
+	gone, _ := before.Acquire("gone")
+
+	// the device of gone was unplugged while the binary was down
+	after := persistentAllocator(b)
+	after.Retain([]string{"attached"})
+	if lease, ok := after.Lookup("attached"); !ok || lease.Ports[Appium] != attached.Ports[Appium] {
+		t.Errorf("lease of attached device dropped, got %v", lease.Ports)
+	}
+	if _, ok := after.Lookup("gone"); ok {
+		t.Error("lease of detached device kept")
+	}
+	if lease, _ := after.Acquire("new"); lease.Ports[Appium] != gone.Ports[Appium] {
+		t.Errorf("port %d of the dropped lease not leased again, got %d", gone.Ports[Appium], lease.Ports[Appium])
+	}
+	if _, ok := persistentAllocator(b).Lookup("gone"); ok {
+		t.Error("dropped lease still persisted")
+	}
+}
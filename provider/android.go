@@ -0,0 +1,428 @@
+package provider
+
+import (
+	"byod/common"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	adb "github.com/zach-klippenstein/goadb"
+)
+
+const retryInterval = 3 * time.Second // wait before reconnecting a broken device stream
+
+// Android serves the devices of the adb server.
+type Android struct {
+	client *adb.Adb
+}
+
+// NewAndroid returns a provider for the devices of the given adb server.
+func NewAndroid(client *adb.Adb) *Android {
+	return &Android{client: client}
+}
+
+func (a *Android) Platform() string {
+	return "android"
+}
+
+func (a *Android) List() ([]string, error) {
+	return a.client.ListDeviceSerials()
+}
+
+// Watch follows adb track-devices.
+func (a *Android) Watch(stop <-chan struct{}, events chan<- Event) {
+	for {
+		watcher := a.client.NewDeviceWatcher()
+		for open := true; open; {
+			select {
+			case <-stop:
+				watcher.Shutdown()
+				return
+			case change, ok := <-watcher.C():
+				if !ok {
+					open = false
+					break
+				}
+				event := Event{
+					Platform: "android",
+					UDID:     change.Serial,
+					Online:   change.NewState == adb.StateOnline,
+					Gone:     change.NewState == adb.StateDisconnected,
+				}
+				select {
+				case events <- event:
+				case <-stop:
+					return
+				}
+			}
+		}
+		log.Println("Android.Watch :: adb device stream closed: ", watcher.Err())
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+func (a *Android) Properties(udid string) (common.DeviceInfo, error) {
+	device := a.client.Device(adb.DeviceWithSerial(udid))
+	var err error
+	getprop := func(name string) string {
+		value, runErr := device.RunCommand("getprop " + name)
+		if runErr != nil {
+			err = runErr
+		}
+		return strings.Trim(value, "\n")
+	}
+	deviceInfo := common.DeviceInfo{
+		OS:        "android",
+		UDID:      udid,
+		Name:      getprop("ro.product.model"),
+		Model:     getprop("ro.product.model"),
+		Brand:     getprop("ro.product.brand"),
+		OSVersion: getprop("ro.build.version.release"),
+	}
+	deviceInfo.FullOSVersion = deviceInfo.OSVersion
+	deviceInfo.Transport = transport(udid)
+	return deviceInfo, err
+}
+
+// transport tells network devices, whose serial is their host:port or a wireless debugging service name, from USB ones.
+func transport(serial string) string {
+	if strings.Contains(serial, "._adb-tls-connect._tcp") || CheckAddress(serial) == nil {
+		return common.TransportNetwork
+	}
+	return common.TransportUSB
+}
+
+// CheckAddress reports whether address is a host:port an adb server can connect to.
+func CheckAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %v", address, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port in address %q", address)
+	}
+	if host == "" || strings.IndexFunc(host, func(c rune) bool {
+		return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune(".-:", c))
+	}) >= 0 {
+		return fmt.Errorf("invalid host in address %q", address)
+	}
+	return nil
+}
+
+// Connect runs adb connect, which exits successfully even when the device does not answer.
+func (a *Android) Connect(address string) error {
+	output, err := common.Execute(fmt.Sprintf("%s connect %s", common.Adb, address))
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(output, "connected to") && !strings.HasPrefix(output, "already connected") {
+		return errors.New(output)
+	}
+	return nil
+}
+
+// Pair runs adb pair against the pairing port shown by the wireless debugging settings of Android 11 and later.
+func (a *Android) Pair(address, code string) error {
+	output, err := common.Execute(fmt.Sprintf("%s pair %s %s", common.Adb, address, code))
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(output, "Successfully paired") {
+		return errors.New(output)
+	}
+	return nil
+}
+
+// Health reads the battery from dumpsys battery, the free storage of /data, the uptime and the screen state.
+// Only a missing battery level fails, the other readings are left empty when unavailable.
+func (a *Android) Health(udid string) (common.DeviceHealth, error) {
+	device := a.client.Device(adb.DeviceWithSerial(udid))
+	output, err := device.RunCommand("dumpsys battery")
+	if err != nil {
+		return common.DeviceHealth{}, err
+	}
+	battery := parseDumpsys(output)
+	level, err := strconv.Atoi(battery["level"])
+	if err != nil {
+		return common.DeviceHealth{}, fmt.Errorf("no battery level in dumpsys output of %s", udid)
+	}
+	health := common.DeviceHealth{BatteryLevel: level, CollectedAt: time.Now()}
+	if tenths, err := strconv.Atoi(battery["temperature"]); err == nil {
+		health.BatteryTemperature = float64(tenths) / 10
+	}
+	health.Charging = battery["status"] == "2" || battery["AC powered"] == "true" ||
+		battery["USB powered"] == "true" || battery["Wireless powered"] == "true"
+
+	if output, err := device.RunCommand("df -k /data"); err == nil {
+		health.StorageTotal, health.StorageFree = parseDf(output)
+	} else {
+		log.Println("Android.Health :: unable to read storage of", udid, ":", err)
+	}
+	if output, err := device.RunCommand("cat /proc/uptime"); err == nil {
+		if fields := strings.Fields(output); len(fields) > 0 {
+			uptime, _ := strconv.ParseFloat(fields[0], 64)
+			health.Uptime = int64(uptime)
+		}
+	}
+	if output, err := device.RunCommand("dumpsys power"); err == nil {
+		health.ScreenState = screenState(output)
+	}
+	return health, nil
+}
+
+// parseDf returns the total and available bytes of the last line of a df -k output.
+func parseDf(output string) (int64, int64) {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(lines) < 2 || len(fields) < 4 {
+		return 0, 0
+	}
+	total, _ := strconv.ParseInt(fields[1], 10, 64)
+	available, _ := strconv.ParseInt(fields[3], 10, 64)
+	return total * 1024, available * 1024
+}
+
+// screenState maps the wakefulness of dumpsys power to on, off or dozing.
+func screenState(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		_, wakefulness, found := strings.Cut(strings.TrimSpace(line), "mWakefulness=")
+		if !found {
+			continue
+		}
+		switch wakefulness {
+		case "Awake":
+			return "on"
+		case "Dozing":
+			return "dozing"
+		default:
+			return "off"
+		}
+	}
+	return ""
+}
+
+// parseDumpsys returns the "key: value" lines of a dumpsys output.
+func parseDumpsys(output string) map[string]string {
+	values := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), ":")
+		if found {
+			values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return values
+}
+
+// Prepare has nothing to provision on Android, the drivers are installed by appium.
+func (a *Android) Prepare(device common.DeviceInfo) error {
+	return nil
+}
+
+// lockscreenMarkers are the dumpsys window entries telling that the keyguard is shown.
+var lockscreenMarkers = []string{"mShowingLockscreen=true", "mDreamingLockscreen=true", "isStatusBarKeyguard=true", "mKeyguardShowing=true"}
+
+// systemDialogs are the focused windows of the system dialogs closed before a session.
+var systemDialogs = []string{"Application Not Responding", "Application Error", "isn't responding", "has stopped", "keeps stopping"}
+
+// PrepareSession checks the device finished booting, keeps it awake while charging, wakes and unlocks the screen
+// with the PIN of the options and closes system dialogs.
+func (a *Android) PrepareSession(udid string, options common.DeviceOptions) error {
+	device := a.client.Device(adb.DeviceWithSerial(udid))
+	booted, err := device.RunCommand("getprop sys.boot_completed")
+	if err != nil {
+		return fmt.Errorf("device %s not responding: %v", udid, err)
+	}
+	if strings.TrimSpace(booted) != "1" {
+		return fmt.Errorf("device %s has not finished booting", udid)
+	}
+	if options.StayAwake {
+		if _, err := device.RunCommand("settings put global stay_on_while_plugged_in 7"); err != nil {
+			return fmt.Errorf("unable to keep %s awake: %v", udid, err)
+		}
+	}
+
+	device.RunCommand("input keyevent KEYCODE_WAKEUP")
+	if lockscreenShown(device) {
+		if err := unlock(device, options.PIN); err != nil {
+			return fmt.Errorf("%w: screen of %s is locked: %v", ErrDeviceLocked, udid, err)
+		}
+	}
+
+	device.RunCommand("am broadcast -a android.intent.action.CLOSE_SYSTEM_DIALOGS")
+	if dialog := focusedDialog(device); dialog != "" {
+		device.RunCommand("input keyevent KEYCODE_BACK")
+		if focusedDialog(device) != "" {
+			return fmt.Errorf("system dialog %q open on %s", dialog, udid)
+		}
+	}
+	return nil
+}
+
+// lockscreenShown reports whether the keyguard covers the screen.
+func lockscreenShown(device *adb.Device) bool {
+	output, err := device.RunCommand("dumpsys window")
+	if err != nil {
+		return false
+	}
+	for _, marker := range lockscreenMarkers {
+		if strings.Contains(output, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// unlock dismisses the keyguard, entering the PIN when one is set.
+func unlock(device *adb.Device, pin string) error {
+	device.RunCommand("wm dismiss-keyguard")
+	if pin != "" {
+		time.Sleep(500 * time.Millisecond) // the PIN pad slides in
+		device.RunCommand("input text " + pin)
+		device.RunCommand("input keyevent KEYCODE_ENTER")
+	}
+	time.Sleep(time.Second)
+	if !lockscreenShown(device) {
+		return nil
+	}
+	if pin == "" {
+		return fmt.Errorf("no PIN configured for the device")
+	}
+	return fmt.Errorf("still locked after entering the PIN")
+}
+
+// focusedDialog returns the system dialog holding the focus, empty if none.
+func focusedDialog(device *adb.Device) string {
+	output, err := device.RunCommand("dumpsys window | grep mCurrentFocus")
+	if err != nil {
+		return ""
+	}
+	for _, dialog := range systemDialogs {
+		if strings.Contains(output, dialog) {
+			return dialog
+		}
+	}
+	return ""
+}
+
+func (a *Android) InstallApp(udid, path string) error {
+	_, err := common.Execute(fmt.Sprintf("%s -s %s install -t %s", common.Adb, udid, path))
+	return err
+}
+
+func (a *Android) UninstallApp(udid, bundle string) error {
+	_, err := common.Execute(fmt.Sprintf("%s -s %s uninstall %s", common.Adb, udid, bundle))
+	return err
+}
+
+func (a *Android) LaunchApp(udid, bundle string) error {
+	_, err := common.Execute(fmt.Sprintf("%s -s %s shell monkey -p %s -c android.intent.category.LAUNCHER 1", common.Adb, udid, bundle))
+	return err
+}
+
+func (a *Android) KillApp(udid, bundle string) error {
+	_, err := common.Execute(fmt.Sprintf("%s -s %s shell am force-stop %s", common.Adb, udid, bundle))
+	return err
+}
+
+func (a *Android) ListApps(udid string) ([]common.AppInfo, error) {
+	command := fmt.Sprintf("%s -s %s shell 'pm list packages -3 | cut -d ':' -f2 | while read line; do version=`dumpsys package $line | grep versionName | cut -d '=' -f2`; echo \"$line $version\"; done'", common.Adb, udid)
+	output, err := common.Execute(command)
+	if err != nil {
+		return nil, err
+	}
+	var appList []common.AppInfo
+	for _, app := range strings.Split(output, "\n") {
+		appInfo := strings.SplitN(app, " ", 2)
+		if len(appInfo) < 2 {
+			continue
+		}
+		appList = append(appList, common.AppInfo{Package: appInfo[0], Version: appInfo[1]})
+	}
+	return appList, nil
+}
+
+func (a *Android) ClearAppData(udid, bundle string) error {
+	_, err := common.Execute(fmt.Sprintf("%s -s %s shell pm clear %s", common.Adb, udid, bundle))
+	return err
+}
+
+func (a *Android) PressHome(udid string) error {
+	_, err := common.Execute(fmt.Sprintf("%s -s %s shell input keyevent KEYCODE_HOME", common.Adb, udid))
+	return err
+}
+
+// ResetRotation turns auto-rotation off and the user rotation back to portrait.
+func (a *Android) ResetRotation(udid string) error {
+	if _, err := common.Execute(fmt.Sprintf("%s -s %s shell settings put system accelerometer_rotation 0", common.Adb, udid)); err != nil {
+		return err
+	}
+	_, err := common.Execute(fmt.Sprintf("%s -s %s shell settings put system user_rotation 0", common.Adb, udid))
+	return err
+}
+
+// SetLocale changes the locale through the appium settings app installed with UiAutomator2.
+func (a *Android) SetLocale(udid, locale string) error {
+	language, country, _ := strings.Cut(locale, "_")
+	_, err := common.Execute(fmt.Sprintf("%s -s %s shell am broadcast -a io.appium.settings.locale -n io.appium.settings/.receivers.LocaleSettingReceiver --es lang %s --es country %s", common.Adb, udid, language, country))
+	return err
+}
+
+func (a *Android) RemoveFiles(udid, path string) error {
+	_, err := common.Execute(fmt.Sprintf("%s -s %s shell rm -rf %s", common.Adb, udid, path))
+	return err
+}
+
+func (a *Android) Reboot(udid string) error {
+	_, err := common.Execute(fmt.Sprintf("%s -s %s reboot", common.Adb, udid))
+	return err
+}
+
+// RecoverySteps reconnects the device from the host, then from the device side, re-pairs network devices,
+// and as a last resort restarts the adb server, which drops the connection of every Android device of the host.
+func (a *Android) RecoverySteps(udid string) []RecoveryStep {
+	steps := []RecoveryStep{
+		{Name: "adb reconnect", Run: func() error {
+			_, err := common.Execute(fmt.Sprintf("%s -s %s reconnect", common.Adb, udid))
+			return err
+		}},
+		{Name: "adb reconnect device", Run: func() error {
+			_, err := common.Execute(fmt.Sprintf("%s -s %s reconnect device", common.Adb, udid))
+			return err
+		}},
+	}
+	if transport(udid) == common.TransportNetwork && CheckAddress(udid) == nil {
+		steps = append(steps, RecoveryStep{Name: "re-pair", Run: func() error { return a.repair(udid) }})
+	}
+	steps = append(steps, RecoveryStep{Name: "adb server restart", HostWide: true, Run: func() error {
+		if _, err := common.Execute(fmt.Sprintf("%s kill-server", common.Adb)); err != nil {
+			log.Println("Android.RecoverySteps :: unable to kill the adb server:", err)
+		}
+		_, err := common.Execute(fmt.Sprintf("%s start-server", common.Adb))
+		return err
+	}})
+	return steps
+}
+
+// repair drops the network connection of the device and connects again, running the wireless debugging
+// handshake with the pairing key of the host anew.
+func (a *Android) repair(address string) error {
+	if _, err := common.Execute(fmt.Sprintf("%s disconnect %s", common.Adb, address)); err != nil {
+		log.Println("Android.repair :: unable to disconnect", address, ":", err)
+	}
+	return a.Connect(address)
+}
+
+// Logs streams logcat.
+func (a *Android) Logs(udid string) (io.ReadCloser, error) {
+	return streamCommand(common.Adb, "-s", udid, "logcat", "-v", "threadtime")
+}
@@ -0,0 +1,289 @@
+package provider
+
+import (
+	"byod/common"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fake is a scriptable in-memory provider simulating attach, detach and state changes of devices.
+type Fake struct {
+	platform string
+	events   chan Event
+
+	mu         sync.Mutex
+	devices    map[string]common.DeviceInfo
+	apps       map[string][]common.AppInfo
+	prepareErr map[string]error
+	sessionErr map[string]error
+	connectErr map[string]error
+	logs       map[string]string
+	health     map[string]common.DeviceHealth
+	calls      []string
+}
+
+// NewFake returns an empty fake provider for the platform.
+func NewFake(platform string) *Fake {
+	return &Fake{
+		platform:   platform,
+		events:     make(chan Event, 64),
+		devices:    make(map[string]common.DeviceInfo),
+		apps:       make(map[string][]common.AppInfo),
+		prepareErr: make(map[string]error),
+		sessionErr: make(map[string]error),
+		connectErr: make(map[string]error),
+		logs:       make(map[string]string),
+		health:     make(map[string]common.DeviceHealth),
+	}
+}
+
+// Attach plugs in an online device with the given properties.
+func (f *Fake) Attach(device common.DeviceInfo) {
+	device.OS = f.platform
+	f.mu.Lock()
+	f.devices[device.UDID] = device
+	f.mu.Unlock()
+	f.events <- Event{Platform: f.platform, UDID: device.UDID, Online: true}
+}
+
+// SetOnline changes whether an attached device accepts commands.
+func (f *Fake) SetOnline(udid string, online bool) {
+	f.events <- Event{Platform: f.platform, UDID: udid, Online: online}
+}
+
+// Detach unplugs a device.
+func (f *Fake) Detach(udid string) {
+	f.mu.Lock()
+	delete(f.devices, udid)
+	f.mu.Unlock()
+	f.events <- Event{Platform: f.platform, UDID: udid, Gone: true}
+}
+
+// FailPrepare makes the preparation of the device fail with err, nil clears the failure.
+func (f *Fake) FailPrepare(udid string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.prepareErr[udid] = err
+}
+
+// FailPrepareSession makes the session preparation of the device fail with err, nil clears the failure.
+func (f *Fake) FailPrepareSession(udid string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sessionErr[udid] = err
+}
+
+// FailConnect makes connecting and pairing the address fail with err, nil clears the failure.
+func (f *Fake) FailConnect(address string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.connectErr[address] = err
+}
+
+// SetLogs sets the log content streamed for the device.
+func (f *Fake) SetLogs(udid, logs string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.logs[udid] = logs
+}
+
+// SetHealth sets the health readings reported for the device.
+func (f *Fake) SetHealth(udid string, health common.DeviceHealth) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.health[udid] = health
+}
+
+// Calls returns the operations run on the provider, such as "prepare <udid>" or "install <udid> <path>".
+func (f *Fake) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// record logs an operation and returns an error when the device is not attached.
+func (f *Fake) record(op, udid string, args ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, strings.Join(append([]string{op, udid}, args...), " "))
+	if _, ok := f.devices[udid]; !ok {
+		return fmt.Errorf("device %s not attached", udid)
+	}
+	return nil
+}
+
+func (f *Fake) Platform() string {
+	return f.platform
+}
+
+func (f *Fake) List() ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var udids []string
+	for udid := range f.devices {
+		udids = append(udids, udid)
+	}
+	return udids, nil
+}
+
+// Watch forwards the scripted events until stop is closed.
+func (f *Fake) Watch(stop <-chan struct{}, events chan<- Event) {
+	for {
+		select {
+		case <-stop:
+			return
+		case event := <-f.events:
+			select {
+			case events <- event:
+			case <-stop:
+				return
+			}
+		}
+	}
+}
+
+func (f *Fake) Properties(udid string) (common.DeviceInfo, error) {
+	if err := f.record("properties", udid); err != nil {
+		return common.DeviceInfo{}, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.devices[udid], nil
+}
+
+func (f *Fake) Health(udid string) (common.DeviceHealth, error) {
+	if err := f.record("health", udid); err != nil {
+		return common.DeviceHealth{}, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	health := f.health[udid]
+	health.CollectedAt = time.Now()
+	return health, nil
+}
+
+func (f *Fake) Prepare(device common.DeviceInfo) error {
+	if err := f.record("prepare", device.UDID); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.prepareErr[device.UDID]
+}
+
+func (f *Fake) PrepareSession(udid string, options common.DeviceOptions) error {
+	if err := f.record("prepare-session", udid); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sessionErr[udid]
+}
+
+func (f *Fake) InstallApp(udid, path string) error {
+	if err := f.record("install", udid, path); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.apps[udid] = append(f.apps[udid], common.AppInfo{Package: path})
+	return nil
+}
+
+func (f *Fake) UninstallApp(udid, bundle string) error {
+	if err := f.record("uninstall", udid, bundle); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	apps := f.apps[udid][:0]
+	for _, app := range f.apps[udid] {
+		if app.Package != bundle {
+			apps = append(apps, app)
+		}
+	}
+	f.apps[udid] = apps
+	return nil
+}
+
+func (f *Fake) LaunchApp(udid, bundle string) error {
+	return f.record("launch", udid, bundle)
+}
+
+func (f *Fake) KillApp(udid, bundle string) error {
+	return f.record("kill", udid, bundle)
+}
+
+func (f *Fake) ListApps(udid string) ([]common.AppInfo, error) {
+	if err := f.record("apps", udid); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]common.AppInfo(nil), f.apps[udid]...), nil
+}
+
+func (f *Fake) ClearAppData(udid, bundle string) error {
+	return f.record("clear", udid, bundle)
+}
+
+func (f *Fake) PressHome(udid string) error {
+	return f.record("home", udid)
+}
+
+func (f *Fake) ResetRotation(udid string) error {
+	return f.record("rotation", udid)
+}
+
+func (f *Fake) SetLocale(udid, locale string) error {
+	return f.record("locale", udid, locale)
+}
+
+func (f *Fake) RemoveFiles(udid, path string) error {
+	return f.record("rm", udid, path)
+}
+
+func (f *Fake) Reboot(udid string) error {
+	return f.record("reboot", udid)
+}
+
+// RecoverySteps returns a reconnect, a reinstall and a host-wide server restart step, all only recorded.
+func (f *Fake) RecoverySteps(udid string) []RecoveryStep {
+	return []RecoveryStep{
+		{Name: "reconnect", Run: func() error { return f.record("reconnect", udid) }},
+		{Name: "reinstall", Run: func() error { return f.record("reinstall", udid) }},
+		{Name: "restart server", HostWide: true, Run: func() error { return f.record("restart-server", udid) }},
+	}
+}
+
+// Connect attaches a network device named after its address, unless it is already attached.
+func (f *Fake) Connect(address string) error {
+	f.mu.Lock()
+	f.calls = append(f.calls, "connect "+address)
+	err := f.connectErr[address]
+	_, attached := f.devices[address]
+	f.mu.Unlock()
+	if err == nil && !attached {
+		f.Attach(common.DeviceInfo{UDID: address, Transport: common.TransportNetwork})
+	}
+	return err
+}
+
+func (f *Fake) Pair(address, code string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "pair "+address+" "+code)
+	return f.connectErr[address]
+}
+
+func (f *Fake) Logs(udid string) (io.ReadCloser, error) {
+	if err := f.record("logs", udid); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return io.NopCloser(strings.NewReader(f.logs[udid])), nil
+}
@@ -0,0 +1,429 @@
+package provider
+
+import (
+	"byod/common"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/instruments"
+)
+
+const (
+	batteryDomain   = "com.apple.mobile.battery" // lockdown domain of the battery values
+	diskUsageDomain = "com.apple.disk_usage"     // lockdown domain of the disk capacity values
+	lockProbeApp    = "com.apple.Preferences"    // app opened and closed to probe the lock state
+	wdaDevicePort   = 8100                       // port WebDriverAgent listens on inside the device
+	wdaProbeTimeout = 3 * time.Second            // longest wait for WebDriverAgent to tell the lock state
+)
+
+// IOS serves the devices of usbmuxd.
+type IOS struct {
+	mu      sync.Mutex
+	ids     map[int]string             // usbmuxd device IDs to UDID, a device may be attached over USB and network
+	entries map[string]ios.DeviceEntry // last usbmuxd entry per UDID
+}
+
+// NewIOS returns a provider for the devices of usbmuxd.
+func NewIOS() *IOS {
+	return &IOS{ids: make(map[int]string), entries: make(map[string]ios.DeviceEntry)}
+}
+
+func (p *IOS) Platform() string {
+	return "ios"
+}
+
+func (p *IOS) List() ([]string, error) {
+	devices, err := ios.ListDevices()
+	if err != nil {
+		return nil, err
+	}
+	var udids []string
+	for _, device := range devices.DeviceList {
+		udids = append(udids, device.Properties.SerialNumber)
+	}
+	return udids, nil
+}
+
+// Watch follows usbmuxd attach and detach messages.
+func (p *IOS) Watch(stop <-chan struct{}, events chan<- Event) {
+	for {
+		receive, closeListener, err := ios.Listen()
+		if err != nil {
+			log.Println("IOS.Watch :: unable to listen to usbmuxd: ", err)
+		} else {
+			stopped := make(chan struct{})
+			go func() {
+				select {
+				case <-stop:
+					closeListener()
+				case <-stopped:
+				}
+			}()
+			err = p.receive(receive, stop, events)
+			close(stopped)
+			log.Println("IOS.Watch :: usbmuxd stream closed: ", err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// receive translates usbmuxd messages into events until the stream fails.
+func (p *IOS) receive(receive func() (ios.AttachedMessage, error), stop <-chan struct{}, events chan<- Event) error {
+	for {
+		msg, err := receive()
+		if err != nil {
+			return err
+		}
+		var event Event
+		switch {
+		case msg.DeviceAttached():
+			udid, first := p.attached(msg)
+			if !first {
+				continue
+			}
+			event = Event{Platform: "ios", UDID: udid, Online: true}
+		case msg.DeviceDetached():
+			udid, last := p.detached(msg.DeviceID)
+			if !last {
+				continue
+			}
+			event = Event{Platform: "ios", UDID: udid, Gone: true}
+		default:
+			continue
+		}
+		select {
+		case events <- event:
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// attached records a usbmuxd connection and reports whether it is the first one of the device.
+func (p *IOS) attached(msg ios.AttachedMessage) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	udid := msg.Properties.SerialNumber
+	_, known := p.entries[udid]
+	p.ids[msg.DeviceID] = udid
+	if !known || msg.Properties.ConnectionType == "USB" {
+		p.entries[udid] = ios.DeviceEntry{DeviceID: msg.DeviceID, Properties: msg.Properties}
+	}
+	return udid, !known
+}
+
+// detached drops a usbmuxd connection and reports whether it was the last one of the device.
+func (p *IOS) detached(deviceID int) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	udid, ok := p.ids[deviceID]
+	if !ok {
+		return "", false
+	}
+	delete(p.ids, deviceID)
+	for _, other := range p.ids {
+		if other == udid {
+			return udid, false
+		}
+	}
+	delete(p.entries, udid)
+	return udid, true
+}
+
+// entry returns the usbmuxd entry of the device.
+func (p *IOS) entry(udid string) (ios.DeviceEntry, error) {
+	p.mu.Lock()
+	entry, ok := p.entries[udid]
+	p.mu.Unlock()
+	if ok {
+		return entry, nil
+	}
+	return ios.GetDevice(udid)
+}
+
+func (p *IOS) Properties(udid string) (common.DeviceInfo, error) {
+	deviceInfo := common.DeviceInfo{OS: "ios", UDID: udid}
+	entry, err := p.entry(udid)
+	if err != nil {
+		return deviceInfo, err
+	}
+	values, err := ios.GetValues(entry)
+	deviceInfo.Name = values.Value.DeviceName
+	deviceInfo.Brand = values.Value.DeviceClass
+	deviceInfo.Model = values.Value.ProductType
+	deviceInfo.FullOSVersion = values.Value.ProductVersion
+	deviceInfo.OSVersion = strings.Split(deviceInfo.FullOSVersion, ".")[0]
+	deviceInfo.Transport = common.TransportUSB
+	if entry.Properties.ConnectionType == "Network" {
+		deviceInfo.Transport = common.TransportNetwork
+	}
+	return deviceInfo, err
+}
+
+// Health reads the battery and disk usage domains over lockdown.
+// Only a missing battery level fails, the disk values are left empty when unavailable.
+func (p *IOS) Health(udid string) (common.DeviceHealth, error) {
+	entry, err := p.entry(udid)
+	if err != nil {
+		return common.DeviceHealth{}, err
+	}
+	conn, err := ios.ConnectLockdownWithSession(entry)
+	if err != nil {
+		return common.DeviceHealth{}, err
+	}
+	defer conn.Close()
+
+	value := func(key, domain string) int64 {
+		v, err := conn.GetValueForDomain(key, domain)
+		if err != nil {
+			return -1
+		}
+		switch n := v.(type) {
+		case uint64:
+			return int64(n)
+		case int64:
+			return n
+		case bool:
+			if n {
+				return 1
+			}
+			return 0
+		}
+		return -1
+	}
+	level := value("BatteryCurrentCapacity", batteryDomain)
+	if level < 0 {
+		return common.DeviceHealth{}, fmt.Errorf("no battery level in lockdown of %s", udid)
+	}
+	health := common.DeviceHealth{
+		BatteryLevel: int(level),
+		Charging:     value("BatteryIsCharging", batteryDomain) == 1,
+		CollectedAt:  time.Now(),
+	}
+	if total, free := value("TotalDataCapacity", diskUsageDomain), value("TotalDataAvailable", diskUsageDomain); total >= 0 && free >= 0 {
+		health.StorageTotal, health.StorageFree = total, free
+	}
+	return health, nil
+}
+
+// Prepare mounts the developer disk image and installs the WebDriverAgent runner.
+func (p *IOS) Prepare(device common.DeviceInfo) error {
+	if err := syncDiskImages(device.UDID, device.FullOSVersion); err != nil {
+		return fmt.Errorf("unable to mount disk image: %v", err)
+	}
+	if err := installRunner(device.UDID); err != nil {
+		log.Println("error while installing runner: ", err.Error())
+	}
+	return nil
+}
+
+// installRunner installs the WebDriverAgent runner shipped in the assets.
+func installRunner(udid string) error {
+	runner := fmt.Sprintf("%s/WebDriverAgentRunner-Runner.app", common.AppDirs.Assets)
+	_, err := common.Execute(fmt.Sprintf("%s install --path=%s --udid %s", common.GoIOS, runner, udid))
+	return err
+}
+
+// PrepareSession checks the device answers lockdown and that its screen is not locked.
+// iOS devices cannot be unlocked or have their dialogs closed from the host, a locked device is refused with ErrDeviceLocked.
+// Lockdown only tells whether a passcode is set, so the lock state is probed on the device itself.
+func (p *IOS) PrepareSession(udid string, options common.DeviceOptions) error {
+	entry, err := p.entry(udid)
+	if err != nil {
+		return fmt.Errorf("device %s not found: %v", udid, err)
+	}
+	if _, err := ios.GetValues(entry); err != nil {
+		return fmt.Errorf("device %s not responding: %v", udid, err)
+	}
+	locked, err := screenLocked(entry)
+	if err != nil {
+		log.Printf("PrepareSession :: lock state of %s unknown, WebDriverAgent will report it: %v\n", udid, err)
+		return nil
+	}
+	if locked {
+		return fmt.Errorf("%w: unlock the screen of %s on the device, it cannot be unlocked from the host", ErrDeviceLocked, udid)
+	}
+	return nil
+}
+
+// screenLocked tells whether the screen of the device is locked.
+// A WebDriverAgent left running answers directly, otherwise SpringBoard refuses to open an app while the screen is locked.
+func screenLocked(entry ios.DeviceEntry) (bool, error) {
+	if locked, err := wdaLocked(entry); err == nil {
+		return locked, nil
+	}
+	control, err := instruments.NewProcessControl(entry)
+	if err != nil {
+		return false, err
+	}
+	defer control.Close()
+	pid, err := control.LaunchApp(lockProbeApp)
+	if err != nil {
+		if strings.Contains(err.Error(), "Locked") {
+			return true, nil
+		}
+		return false, err
+	}
+	control.KillProcess(pid)
+	return false, nil
+}
+
+// wdaLocked asks the WebDriverAgent listening on the device whether the screen is locked.
+func wdaLocked(entry ios.DeviceEntry) (bool, error) {
+	client := &http.Client{
+		Timeout: wdaProbeTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				muxConn, err := ios.NewUsbMuxConnectionSimple()
+				if err != nil {
+					return nil, err
+				}
+				if err := muxConn.Connect(entry.DeviceID, wdaDevicePort); err != nil {
+					muxConn.Close()
+					return nil, err
+				}
+				return muxConn.ReleaseDeviceConnection().Conn(), nil
+			},
+		},
+	}
+	resp, err := client.Get("http://wda/wda/locked")
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("WebDriverAgent answered %s", resp.Status)
+	}
+	var locked struct {
+		Value bool `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&locked); err != nil {
+		return false, err
+	}
+	return locked.Value, nil
+}
+
+// syncDiskImages downloads the disk images of the iOS version when missing and mounts them on the device.
+func syncDiskImages(udid, version string) error {
+	diskImagesPath := fmt.Sprintf("%s/%s", common.AppDirs.DiskImages, version)
+	_, err := os.Stat(diskImagesPath)
+	if err == nil {
+		return nil
+	}
+
+	source := fmt.Sprintf("%s/diskimages/%s.zip", common.SanitisatioEndpoint, version)
+	target := fmt.Sprintf("%s/%s.zip", common.AppDirs.DiskImages, version)
+	common.Download(source, target)
+	common.Unzip(target, common.AppDirs.DiskImages)
+	return mountDiskImages(udid)
+}
+
+// mountDiskImages mounts the developer disk image matching the device.
+func mountDiskImages(udid string) error {
+	_, err := common.Execute(fmt.Sprintf("%s image auto --basedir=%s/diskimages --udid %s", common.GoIOS, common.AppDirs.Assets, udid))
+	return err
+}
+
+func (p *IOS) InstallApp(udid, path string) error {
+	_, err := common.Execute(fmt.Sprintf("%s install --path=%s --udid %s", common.GoIOS, path, udid))
+	return err
+}
+
+func (p *IOS) UninstallApp(udid, bundle string) error {
+	_, err := common.Execute(fmt.Sprintf("%s uninstall %s --udid %s", common.GoIOS, bundle, udid))
+	return err
+}
+
+func (p *IOS) LaunchApp(udid, bundle string) error {
+	_, err := common.Execute(fmt.Sprintf("%s launch %s --udid %s", common.GoIOS, bundle, udid))
+	return err
+}
+
+func (p *IOS) KillApp(udid, bundle string) error {
+	_, err := common.Execute(fmt.Sprintf("%s kill %s --udid %s", common.GoIOS, bundle, udid))
+	return err
+}
+
+func (p *IOS) ListApps(udid string) ([]common.AppInfo, error) {
+	output, err := common.Execute(fmt.Sprintf("%s apps --list --udid %s", common.GoIOS, udid))
+	if err != nil {
+		return nil, err
+	}
+	var appList []common.AppInfo
+	for _, app := range strings.Split(output, "\n") {
+		appInfo := strings.Split(app, " ")
+		if len(appInfo) < 3 {
+			continue
+		}
+		appList = append(appList, common.AppInfo{Name: appInfo[1], Package: appInfo[0], Version: appInfo[2]})
+	}
+	return appList, nil
+}
+
+// ClearAppData is not possible without reinstalling the app on iOS.
+func (p *IOS) ClearAppData(udid, bundle string) error {
+	return ErrUnsupported
+}
+
+// PressHome needs WebDriverAgent, which only runs during sessions.
+func (p *IOS) PressHome(udid string) error {
+	return ErrUnsupported
+}
+
+// ResetRotation needs WebDriverAgent, which only runs during sessions.
+func (p *IOS) ResetRotation(udid string) error {
+	return ErrUnsupported
+}
+
+func (p *IOS) SetLocale(udid, locale string) error {
+	language, _, _ := strings.Cut(locale, "_")
+	_, err := common.Execute(fmt.Sprintf("%s lang --setlocale=%s --setlang=%s --udid %s", common.GoIOS, locale, language, udid))
+	return err
+}
+
+// RemoveFiles deletes a path of the media partition served by AFC.
+func (p *IOS) RemoveFiles(udid, path string) error {
+	_, err := common.Execute(fmt.Sprintf("%s fsync rm --r --path=%s --udid %s", common.GoIOS, path, udid))
+	return err
+}
+
+func (p *IOS) Reboot(udid string) error {
+	_, err := common.Execute(fmt.Sprintf("%s reboot --udid %s", common.GoIOS, udid))
+	return err
+}
+
+// RecoverySteps pairs the device again, then reinstalls the WebDriverAgent runner, then mounts the disk images again.
+func (p *IOS) RecoverySteps(udid string) []RecoveryStep {
+	return []RecoveryStep{
+		{Name: "re-pair", Run: func() error {
+			_, err := common.Execute(fmt.Sprintf("%s pair --udid %s", common.GoIOS, udid))
+			return err
+		}},
+		{Name: "reinstall WebDriverAgent runner", Run: func() error {
+			return installRunner(udid)
+		}},
+		{Name: "re-mount disk images", Run: func() error {
+			return mountDiskImages(udid)
+		}},
+	}
+}
+
+// Logs streams the device syslog.
+func (p *IOS) Logs(udid string) (io.ReadCloser, error) {
+	return streamCommand(common.GoIOS, "syslog", "--udid", udid)
+}
@@ -0,0 +1,123 @@
+package provider
+
+import (
+	"byod/common"
+	"errors"
+	"io"
+	"os/exec"
+	"sync"
+)
+
+// Event is a change reported by the device stream of a provider.
+type Event struct {
+	Platform string
+	UDID     string
+	Online   bool // the device accepts commands
+	Gone     bool // the device was detached
+}
+
+// DeviceProvider discovers and drives the devices of one platform.
+type DeviceProvider interface {
+	// Platform returns the OS of the devices served, "ios" or "android".
+	Platform() string
+	// List returns the UDIDs of the attached devices.
+	List() ([]string, error)
+	// Watch sends attach, detach and state change events until stop is closed, reconnecting broken streams.
+	Watch(stop <-chan struct{}, events chan<- Event)
+	// Properties reads the name, brand and OS versions of an attached device.
+	Properties(udid string) (common.DeviceInfo, error)
+	// Health reads the battery and other health values of an attached device.
+	Health(udid string) (common.DeviceHealth, error)
+	// Prepare provisions an attached device before it can serve sessions.
+	Prepare(device common.DeviceInfo) error
+	// PrepareSession wakes and unlocks the device, closes system dialogs and checks it answers, before every session.
+	PrepareSession(udid string, options common.DeviceOptions) error
+	InstallApp(udid, path string) error
+	UninstallApp(udid, bundle string) error
+	LaunchApp(udid, bundle string) error
+	KillApp(udid, bundle string) error
+	ListApps(udid string) ([]common.AppInfo, error)
+	// ClearAppData deletes the data of an installed app.
+	ClearAppData(udid, bundle string) error
+	// PressHome returns to the home screen, closing open dialogs.
+	PressHome(udid string) error
+	// ResetRotation locks the screen in portrait.
+	ResetRotation(udid string) error
+	// SetLocale sets the language and region of the device, locale is of the form en_US.
+	SetLocale(udid, locale string) error
+	// RemoveFiles deletes a file or directory from the device storage.
+	RemoveFiles(udid, path string) error
+	// Logs streams the device log until the returned reader is closed.
+	Logs(udid string) (io.ReadCloser, error)
+	// Reboot restarts the device.
+	Reboot(udid string) error
+	// RecoverySteps lists the repairs to try in order on a device that does not work, least disruptive first.
+	RecoverySteps(udid string) []RecoveryStep
+}
+
+// NetworkConnector is implemented by the providers of devices reachable over the network.
+type NetworkConnector interface {
+	// Connect attaches the device listening at address, of the form host:port.
+	Connect(address string) error
+	// Pair trusts the host on a device showing a wireless debugging pairing code.
+	Pair(address, code string) error
+}
+
+// RecoveryStep is one repair of a device or of its connection to the host.
+type RecoveryStep struct {
+	Name     string
+	Run      func() error
+	HostWide bool // disrupts every device of the platform on the host, only run while no other device is in a session
+}
+
+// ErrUnsupported is returned by operations the platform cannot perform.
+var ErrUnsupported = errors.New("not supported on this platform")
+
+// ErrDeviceLocked is returned when the screen of a device is locked and cannot be unlocked from the host.
+var ErrDeviceLocked = errors.New("device locked")
+
+var (
+	mu        sync.RWMutex
+	providers = make(map[string]DeviceProvider)
+)
+
+// Register makes the provider available for its platform.
+func Register(p DeviceProvider) {
+	mu.Lock()
+	defer mu.Unlock()
+	providers[p.Platform()] = p
+}
+
+// Get returns the provider registered for the platform.
+func Get(platform string) (DeviceProvider, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	p, ok := providers[platform]
+	return p, ok
+}
+
+// commandStream is the output of a long running command, closing it kills the command.
+type commandStream struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+// streamCommand starts the command and returns its standard output.
+func streamCommand(name string, args ...string) (io.ReadCloser, error) {
+	cmd := exec.Command(name, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &commandStream{ReadCloser: stdout, cmd: cmd}, nil
+}
+
+// Close kills the command and releases its resources.
+func (s *commandStream) Close() error {
+	s.cmd.Process.Kill()
+	s.ReadCloser.Close()
+	return s.cmd.Wait()
+}
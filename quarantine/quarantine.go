@@ -0,0 +1,168 @@
+package quarantine
+
+import (
+	"byod/common"
+	"byod/registry"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Signal is an outcome of a device operation counted in the health score of the device.
+type Signal string
+
+const (
+	SessionStarted Signal = "session_started" // appium created a session on the device
+	AppInstalled   Signal = "app_installed"   // an app was installed on the device
+	SessionFailed  Signal = "session_failed"  // appium did not start or did not create a session
+	Disconnected   Signal = "disconnected"    // the device went away during a session
+	DriverCrashed  Signal = "driver_crashed"  // appium, WebDriverAgent or UiAutomator2 crashed during a session
+	InstallFailed  Signal = "install_failed"  // an app could not be installed on the device
+)
+
+// penalties weighs the failure signals, every success weighs one.
+var penalties = map[Signal]int{
+	SessionFailed: 1,
+	Disconnected:  2,
+	DriverCrashed: 1,
+	InstallFailed: 1,
+}
+
+const (
+	window           = 20 // most recent signals scored per device
+	minSignals       = 5  // signals needed before a device can be quarantined
+	DefaultThreshold = 50 // score below which devices are quarantined
+)
+
+// Tracker scores devices from their recent signals and quarantines the ones below the threshold.
+// It is safe for concurrent use.
+type Tracker struct {
+	registry *registry.Registry
+
+	mu        sync.Mutex
+	threshold int
+	signals   map[string][]Signal
+}
+
+// Default is the tracker of the devices in the default registry.
+var Default = New(registry.Default)
+
+// New returns a tracker of the devices in the registry with the default threshold.
+func New(devices *registry.Registry) *Tracker {
+	return &Tracker{registry: devices, threshold: DefaultThreshold, signals: make(map[string][]Signal)}
+}
+
+// SetThreshold sets the score below which devices are quarantined, zero disables quarantine.
+func (t *Tracker) SetThreshold(threshold int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.threshold = threshold
+}
+
+// Score returns the health score of the device, 100 without signals.
+func (t *Tracker) Score(udid string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return score(t.signals[udid])
+}
+
+// Due reports whether the device must be quarantined instead of going back to ready.
+func (t *Tracker) Due(udid string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.due(t.signals[udid])
+}
+
+// Record adds a signal to the device and quarantines it right away when it is ready and its score fell below the threshold.
+// Devices in a session are quarantined once the session ends, see Admit.
+func (t *Tracker) Record(udid string, signal Signal) {
+	t.mu.Lock()
+	signals := append(t.signals[udid], signal)
+	if len(signals) > window {
+		signals = signals[len(signals)-window:]
+	}
+	t.signals[udid] = signals
+	current, due := score(signals), t.due(signals)
+	t.mu.Unlock()
+
+	if _, failed := penalties[signal]; failed {
+		log.Printf("quarantine :: %s on %s, health score %d\n", signal, udid, current)
+	}
+	t.registry.Update(udid, func(device *common.DeviceInfo) error {
+		device.HealthScore = current
+		return nil
+	})
+	if device, ok := t.registry.Get(udid); ok && due && device.State == common.StateReady {
+		t.registry.Transition(udid, common.StateQuarantined, t.reason(current))
+	}
+}
+
+// Admit moves the device to ready, or to quarantined when its score is below the threshold.
+func (t *Tracker) Admit(udid, reason string) error {
+	t.mu.Lock()
+	current, due := score(t.signals[udid]), t.due(t.signals[udid])
+	t.mu.Unlock()
+	if due {
+		return t.registry.Transition(udid, common.StateQuarantined, t.reason(current))
+	}
+	return t.registry.Transition(udid, common.StateReady, reason)
+}
+
+// Readmit forgets the signals of a device that passed its self-test and moves it to ready.
+func (t *Tracker) Readmit(udid string) error {
+	t.mu.Lock()
+	delete(t.signals, udid)
+	t.mu.Unlock()
+	t.registry.Update(udid, func(device *common.DeviceInfo) error {
+		device.HealthScore = score(nil)
+		return nil
+	})
+	return t.registry.Transition(udid, common.StateReady, "self-test passed")
+}
+
+// due reports whether enough signals were recorded and they score below the threshold, the caller must hold the lock.
+func (t *Tracker) due(signals []Signal) bool {
+	return t.threshold > 0 && len(signals) >= minSignals && score(signals) < t.threshold
+}
+
+func (t *Tracker) reason(current int) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return fmt.Sprintf("health score %d below %d", current, t.threshold)
+}
+
+// score returns the share of successes in the signals, failures counted with their penalty.
+func score(signals []Signal) int {
+	if len(signals) == 0 {
+		return 100
+	}
+	successes, failures := 0, 0
+	for _, signal := range signals {
+		if penalty, failed := penalties[signal]; failed {
+			failures += penalty
+		} else {
+			successes++
+		}
+	}
+	return 100 * successes / (successes + failures)
+}
+
+// SetThreshold sets the quarantine threshold of the default tracker.
+func SetThreshold(threshold int) {
+	Default.SetThreshold(threshold)
+}
+
+// Record adds a signal to a device of the default tracker.
+func Record(udid string, signal Signal) {
+	Default.Record(udid, signal)
+}
+
+// Admit moves a device of the default tracker to ready, or to quarantined when its score is too low.
+func Admit(udid, reason string) error {
+	return Default.Admit(udid, reason)
+}
+
+// Readmit moves a device of the default tracker that passed its self-test back to ready.
+func Readmit(udid string) error {
+	return Default.Readmit(udid)
+}
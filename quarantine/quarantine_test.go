@@ -0,0 +1,98 @@
+package quarantine
+
+import (
+	"byod/common"
+	"byod/registry"
+	"testing"
+)
+
+// newTracker returns a tracker over a registry holding one device in the given state.
+func newTracker(t *testing.T, udid string, state common.DeviceState) (*Tracker, *registry.Registry) {
+	t.Helper()
+	devices := registry.New()
+	if err := devices.Add(common.DeviceInfo{UDID: udid, State: state, HealthScore: 100}); err != nil {
+		t.Fatal(err)
+	}
+	return New(devices), devices
+}
+
+func TestScore(t *testing.T) {
+	tests := []struct {
+		signals []Signal
+		want    int
+	}{
+		{nil, 100},
+		{[]Signal{SessionStarted, AppInstalled}, 100},
+		{[]Signal{SessionStarted, SessionFailed}, 50},
+		{[]Signal{SessionStarted, SessionStarted, Disconnected}, 50},
+		{[]Signal{DriverCrashed, InstallFailed}, 0},
+	}
+	for _, test := range tests {
+		if got := score(test.signals); got != test.want {
+			t.Errorf("score(%v) = %d, want %d", test.signals, got, test.want)
+		}
+	}
+}
+
+func TestRecordQuarantinesReadyDeviceBelowThreshold(t *testing.T) {
+	tracker, devices := newTracker(t, "a", common.StateReady)
+
+	for i := 0; i < minSignals-1; i++ {
+		tracker.Record("a", SessionFailed)
+	}
+	if device, _ := devices.Get("a"); device.State != common.StateReady || device.HealthScore != 0 {
+		t.Fatalf("device quarantined before enough signals %+v", device)
+	}
+	tracker.Record("a", SessionFailed)
+	device, _ := devices.Get("a")
+	if device.State != common.StateQuarantined || device.Status != "connected" {
+		t.Errorf("failing device not quarantined %+v", device)
+	}
+	if device.State.Schedulable() {
+		t.Error("quarantined device is schedulable")
+	}
+}
+
+func TestDeviceInSessionIsQuarantinedOnAdmit(t *testing.T) {
+	tracker, devices := newTracker(t, "b", common.StateInSession)
+	for i := 0; i < minSignals; i++ {
+		tracker.Record("b", DriverCrashed)
+	}
+	if device, _ := devices.Get("b"); device.State != common.StateInSession {
+		t.Fatalf("running session interrupted by quarantine %+v", device)
+	}
+
+	devices.Transition("b", common.StateCleaning, "test")
+	if err := tracker.Admit("b", "cleaned"); err != nil {
+		t.Fatal(err)
+	}
+	if device, _ := devices.Get("b"); device.State != common.StateQuarantined {
+		t.Errorf("failing device went back to %s", device.State)
+	}
+}
+
+func TestReadmitClearsSignals(t *testing.T) {
+	tracker, devices := newTracker(t, "c", common.StateReady)
+	for i := 0; i < minSignals; i++ {
+		tracker.Record("c", InstallFailed)
+	}
+	devices.Transition("c", common.StatePreparing, "self-test")
+	if err := tracker.Readmit("c"); err != nil {
+		t.Fatal(err)
+	}
+	device, _ := devices.Get("c")
+	if device.State != common.StateReady || device.HealthScore != 100 || tracker.Due("c") {
+		t.Errorf("device not readmitted %+v", device)
+	}
+}
+
+func TestZeroThresholdDisablesQuarantine(t *testing.T) {
+	tracker, devices := newTracker(t, "d", common.StateReady)
+	tracker.SetThreshold(0)
+	for i := 0; i < window; i++ {
+		tracker.Record("d", Disconnected)
+	}
+	if device, _ := devices.Get("d"); device.State != common.StateReady {
+		t.Errorf("device quarantined with quarantine disabled %+v", device)
+	}
+}
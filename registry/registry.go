@@ -0,0 +1,256 @@
+package registry
+
+import (
+	"byod/common"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// EventType tells what happened to a device.
+type EventType string
+
+const (
+	Added   EventType = "added"
+	Updated EventType = "updated"
+	Removed EventType = "removed"
+)
+
+// Event is a change of a device sent to subscribers.
+type Event struct {
+	Type     EventType
+	Device   common.DeviceInfo // snapshot after the change, the last snapshot for Removed
+	Previous common.DeviceInfo // snapshot before the change, empty for Added
+}
+
+// StateChanged reports whether the event moved the device to another state.
+func (e Event) StateChanged() bool {
+	return e.Type == Added || e.Device.State != e.Previous.State
+}
+
+// Filter selects devices in List.
+type Filter func(device common.DeviceInfo) bool
+
+// Registry holds the current snapshot of every device attached to the host. It is safe for concurrent use.
+type Registry struct {
+	mu          sync.RWMutex
+	devices     map[string]common.DeviceInfo
+	subscribers map[*subscriber]struct{}
+}
+
+// Default is the registry of the host, filled by the watcher.
+var Default = New()
+
+// New returns an empty registry.
+func New() *Registry {
+	return &Registry{
+		devices:     make(map[string]common.DeviceInfo),
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+// Get returns the snapshot of a device.
+func (r *Registry) Get(udid string) (common.DeviceInfo, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	device, ok := r.devices[udid]
+	return device, ok
+}
+
+// Contains reports whether the device is attached.
+func (r *Registry) Contains(udid string) bool {
+	_, ok := r.Get(udid)
+	return ok
+}
+
+// List returns the devices matching every filter, sorted by UDID.
+func (r *Registry) List(filters ...Filter) []common.DeviceInfo {
+	r.mu.RLock()
+	var devices []common.DeviceInfo
+	for _, device := range r.devices {
+		if matchesAll(device, filters) {
+			devices = append(devices, device)
+		}
+	}
+	r.mu.RUnlock()
+	sort.Slice(devices, func(i, j int) bool { return devices[i].UDID < devices[j].UDID })
+	return devices
+}
+
+// Add records a new device, replacing nothing. It fails when the device is already known.
+func (r *Registry) Add(device common.DeviceInfo) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.devices[device.UDID]; ok {
+		return fmt.Errorf("device %s is already registered", device.UDID)
+	}
+	r.devices[device.UDID] = device
+	r.publish(Event{Type: Added, Device: device})
+	return nil
+}
+
+// Update applies the change to a device atomically, the device is left untouched when change fails.
+func (r *Registry) Update(udid string, change func(device *common.DeviceInfo) error) (common.DeviceInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	previous, ok := r.devices[udid]
+	if !ok {
+		return common.DeviceInfo{}, fmt.Errorf("device %s is not attached", udid)
+	}
+	device := previous
+	if err := change(&device); err != nil {
+		return previous, err
+	}
+	r.devices[udid] = device
+	r.publish(Event{Type: Updated, Device: device, Previous: previous})
+	return device, nil
+}
+
+// Transition moves a device to a new state, validated against the device lifecycle.
+func (r *Registry) Transition(udid string, to common.DeviceState, reason string) error {
+	device, err := r.Update(udid, func(device *common.DeviceInfo) error {
+		return device.Transition(to, reason, time.Now())
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("transition :: %s %s -> %s (%s)\n", udid, device.PreviousState, to, reason)
+	return nil
+}
+
+// Remove forgets a device and returns its last snapshot.
+func (r *Registry) Remove(udid string) (common.DeviceInfo, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	device, ok := r.devices[udid]
+	if !ok {
+		return common.DeviceInfo{}, false
+	}
+	delete(r.devices, udid)
+	r.publish(Event{Type: Removed, Device: device, Previous: device})
+	return device, true
+}
+
+// Subscribe returns a channel receiving every later change in order, and a function ending the subscription.
+// Slow subscribers never block the registry, their events are queued.
+func (r *Registry) Subscribe() (<-chan Event, func()) {
+	s := &subscriber{out: make(chan Event), wake: make(chan struct{}, 1), done: make(chan struct{})}
+	r.mu.Lock()
+	r.subscribers[s] = struct{}{}
+	r.mu.Unlock()
+	go s.deliver()
+
+	var once sync.Once
+	return s.out, func() {
+		once.Do(func() {
+			r.mu.Lock()
+			delete(r.subscribers, s)
+			r.mu.Unlock()
+			close(s.done)
+		})
+	}
+}
+
+// publish queues the event for every subscriber, called with the lock held so that events keep their order.
+func (r *Registry) publish(event Event) {
+	for s := range r.subscribers {
+		s.push(event)
+	}
+}
+
+// subscriber is an unbounded, ordered queue of events delivered to one consumer.
+type subscriber struct {
+	mu    sync.Mutex
+	queue []Event
+	out   chan Event
+	wake  chan struct{}
+	done  chan struct{}
+}
+
+func (s *subscriber) push(event Event) {
+	s.mu.Lock()
+	s.queue = append(s.queue, event)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver sends the queued events until the subscription ends, then closes the channel.
+func (s *subscriber) deliver() {
+	defer close(s.out)
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		event := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		select {
+		case s.out <- event:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func matchesAll(device common.DeviceInfo, filters []Filter) bool {
+	for _, filter := range filters {
+		if !filter(device) {
+			return false
+		}
+	}
+	return true
+}
+
+// ByOS selects devices of the platform.
+func ByOS(os string) Filter {
+	return func(device common.DeviceInfo) bool {
+		return device.OS == os
+	}
+}
+
+// ByState selects devices in one of the states.
+func ByState(states ...common.DeviceState) Filter {
+	return func(device common.DeviceInfo) bool {
+		for _, state := range states {
+			if device.State == state {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Schedulable selects devices that can take sessions, possibly after a queue.
+func Schedulable() Filter {
+	return func(device common.DeviceInfo) bool {
+		return device.State.Schedulable()
+	}
+}
+
+// Get returns the snapshot of a device from the default registry.
+func Get(udid string) (common.DeviceInfo, bool) {
+	return Default.Get(udid)
+}
+
+// List returns the matching devices of the default registry.
+func List(filters ...Filter) []common.DeviceInfo {
+	return Default.List(filters...)
+}
+
+// Transition moves a device of the default registry to a new state.
+func Transition(udid string, to common.DeviceState, reason string) error {
+	return Default.Transition(udid, to, reason)
+}
@@ -0,0 +1,135 @@
+package registry
+
+import (
+	"byod/common"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestListFiltersAndSorts(t *testing.T) {
+	r := New()
+	for _, device := range []common.DeviceInfo{
+		{UDID: "c", OS: "ios", State: common.StateReady},
+		{UDID: "a", OS: "android", State: common.StateReady},
+		{UDID: "b", OS: "android", State: common.StateUnhealthy},
+	} {
+		if err := r.Add(device); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Add(common.DeviceInfo{UDID: "a"}); err == nil {
+		t.Error("duplicate device accepted")
+	}
+
+	var udids []string
+	for _, device := range r.List(ByOS("android")) {
+		udids = append(udids, device.UDID)
+	}
+	if fmt.Sprint(udids) != "[a b]" {
+		t.Errorf("android devices %v, want [a b]", udids)
+	}
+	if ready := r.List(ByOS("android"), ByState(common.StateReady)); len(ready) != 1 || ready[0].UDID != "a" {
+		t.Errorf("ready android devices %+v", ready)
+	}
+	if schedulable := r.List(Schedulable()); len(schedulable) != 2 {
+		t.Errorf("%d schedulable devices, want 2", len(schedulable))
+	}
+}
+
+func TestTransitionIsValidated(t *testing.T) {
+	r := New()
+	r.Add(common.DeviceInfo{UDID: "a", State: common.StateReady})
+
+	if err := r.Transition("a", common.StateCleaning, "test"); err == nil {
+		t.Error("ready device moved to cleaning")
+	}
+	if device, _ := r.Get("a"); device.State != common.StateReady {
+		t.Errorf("refused transition changed the device to %s", device.State)
+	}
+	if err := r.Transition("a", common.StateInSession, "test"); err != nil {
+		t.Fatal(err)
+	}
+	device, _ := r.Get("a")
+	if device.State != common.StateInSession || device.PreviousState != common.StateReady || device.StateReason != "test" {
+		t.Errorf("unexpected device after transition %+v", device)
+	}
+	if err := r.Transition("missing", common.StateReady, "test"); err == nil {
+		t.Error("unknown device transitioned")
+	}
+}
+
+func TestSubscribersReceiveChangesInOrder(t *testing.T) {
+	r := New()
+	events, unsubscribe := r.Subscribe()
+
+	r.Add(common.DeviceInfo{UDID: "a", State: common.StateDetected})
+	r.Transition("a", common.StatePreparing, "test")
+	r.Update("a", func(device *common.DeviceInfo) error {
+		device.Name = "Pixel"
+		return nil
+	})
+	r.Transition("a", common.StateReady, "test")
+	r.Remove("a")
+
+	want := []struct {
+		kind    EventType
+		state   common.DeviceState
+		changed bool
+	}{
+		{Added, common.StateDetected, true},
+		{Updated, common.StatePreparing, true},
+		{Updated, common.StatePreparing, false},
+		{Updated, common.StateReady, true},
+		{Removed, common.StateReady, false},
+	}
+	for i, w := range want {
+		select {
+		case event := <-events:
+			if event.Type != w.kind || event.Device.State != w.state || event.StateChanged() != w.changed {
+				t.Errorf("event %d is %s %s changed=%v, want %s %s changed=%v",
+					i, event.Type, event.Device.State, event.StateChanged(), w.kind, w.state, w.changed)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d not delivered", i)
+		}
+	}
+
+	unsubscribe()
+	unsubscribe()
+	if _, open := <-events; open {
+		t.Error("channel still open after unsubscribe")
+	}
+}
+
+func TestConcurrentUpdatesAreSerialized(t *testing.T) {
+	r := New()
+	r.Add(common.DeviceInfo{UDID: "a"})
+	events, unsubscribe := r.Subscribe()
+	defer unsubscribe()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Update("a", func(device *common.DeviceInfo) error {
+				device.Brand += "x"
+				return nil
+			})
+			r.List()
+		}()
+	}
+	wg.Wait()
+
+	if device, _ := r.Get("a"); len(device.Brand) != 50 {
+		t.Errorf("lost updates, brand has %d marks", len(device.Brand))
+	}
+	for i := 1; i <= 50; i++ {
+		event := <-events
+		if len(event.Device.Brand) != i || len(event.Previous.Brand) != i-1 {
+			t.Fatalf("event %d out of order: %q after %q", i, event.Device.Brand, event.Previous.Brand)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package services
+
+import (
+	"byod/common"
+	"byod/ports"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	appiumStartupTimeout = 60 * time.Second       // maximum time to wait for appium to report ready
+	appiumPollInterval   = 250 * time.Millisecond // interval between two status probes
+	appiumMaxRestarts    = 3                      // crash restarts allowed per supervised server
+)
+
+var errAppiumStopped = errors.New("appium server stopped")
+
+// appiumStatus is the subset of the appium /status response used for readiness probing.
+type appiumStatus struct {
+	Value struct {
+		Ready   bool   `json:"ready"`
+		Message string `json:"message"`
+	} `json:"value"`
+}
+
+// appiumServer supervises a single appium process serving one device.
+type appiumServer struct {
+	udid    string
+	port    string
+	logPath string
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	exited   chan struct{} // closed once the current process has exited
+	exitErr  error         // exit status of the last process, valid after exited is closed
+	restarts int
+	stopped  bool
+}
+
+// newAppiumServer returns a supervisor for an appium server on the given port.
+func newAppiumServer(udid, port, logPath string) *appiumServer {
+	return &appiumServer{udid: udid, port: port, logPath: logPath}
+}
+
+// start launches the appium process and waits until it is ready to accept sessions.
+func (s *appiumServer) start() error {
+	if !common.IsPortAvailable(s.port) {
+		return fmt.Errorf("appium port %s is already in use", s.port)
+	}
+	if err := s.launch(); err != nil {
+		return err
+	}
+	return s.waitUntilReady(appiumStartupTimeout)
+}
+
+// launch starts a new appium process and a goroutine watching for its exit.
+func (s *appiumServer) launch() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return errAppiumStopped
+	}
+
+	cmd := exec.Command("appium", "--base-path", "/wd/hub", "-p", s.port, "--log", s.logPath)
+	// Run appium in its own process group so that its node children are killed with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to launch appium: %v", err)
+	}
+	log.Printf("appium :: started for %s on port %s, pid %d\n", s.udid, s.port, cmd.Process.Pid)
+
+	s.cmd = cmd
+	s.exited = make(chan struct{})
+	s.exitErr = nil
+	go s.supervise(cmd, s.exited)
+	return nil
+}
+
+// supervise waits for the process to exit, records its status and restarts it after a crash.
+func (s *appiumServer) supervise(cmd *exec.Cmd, exited chan struct{}) {
+	err := cmd.Wait()
+
+	s.mu.Lock()
+	s.exitErr = err
+	close(exited)
+	stopped := s.stopped
+	restart := !stopped && s.restarts < appiumMaxRestarts
+	if restart {
+		s.restarts++
+	}
+	s.mu.Unlock()
+
+	if stopped {
+		return
+	}
+	log.Printf("appium :: server for %s on port %s exited unexpectedly: %v\n", s.udid, s.port, exitStatus(err))
+	if !restart {
+		log.Printf("appium :: restart limit reached for %s, giving up\n", s.udid)
+		return
+	}
+
+	log.Printf("appium :: restarting server for %s (attempt %d/%d)\n", s.udid, s.restarts, appiumMaxRestarts)
+	if err := s.launch(); err != nil {
+		log.Printf("appium :: restart failed for %s: %v\n", s.udid, err)
+		return
+	}
+	if err := s.waitUntilReady(appiumStartupTimeout); err != nil {
+		log.Printf("appium :: restarted server for %s not ready: %v\n", s.udid, err)
+	}
+}
+
+// waitUntilReady polls the appium status endpoint until it reports ready, the process exits or the timeout expires.
+func (s *appiumServer) waitUntilReady(timeout time.Duration) error {
+	s.mu.Lock()
+	exited := s.exited
+	s.mu.Unlock()
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	statusURL := fmt.Sprintf("http://localhost:%s/wd/hub/status", s.port)
+	deadline := time.Now().Add(timeout)
+	for {
+		select {
+		case <-exited:
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.stopped {
+				return errAppiumStopped
+			}
+			return fmt.Errorf("appium exited before becoming ready: %v (see %s)", exitStatus(s.exitErr), s.logPath)
+		default:
+		}
+
+		if ready, _ := probeAppium(client, statusURL); ready {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("appium on port %s not ready after %v (see %s)", s.port, timeout, s.logPath)
+		}
+		time.Sleep(appiumPollInterval)
+	}
+}
+
+// alive reports whether the appium process is currently running.
+func (s *appiumServer) alive() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.exited != nil && !isClosed(s.exited)
+}
+
+// crashed reports whether the appium process died on its own since it was first started.
+func (s *appiumServer) crashed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.restarts > 0 || (s.exited != nil && !s.stopped && isClosed(s.exited))
+}
+
+// isClosed reports whether the channel has been closed.
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop kills the appium process group and prevents further restarts.
+func (s *appiumServer) stop() {
+	s.mu.Lock()
+	s.stopped = true
+	cmd := s.cmd
+	s.mu.Unlock()
+
+	if cmd != nil && cmd.Process != nil {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// probeAppium queries the appium status endpoint and reports whether the server is ready.
+func probeAppium(client *http.Client, statusURL string) (bool, error) {
+	resp, err := client.Get(statusURL)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("status endpoint returned %s", resp.Status)
+	}
+	var status appiumStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return false, err
+	}
+	return status.Value.Ready, nil
+}
+
+// exitStatus formats a process exit error for logging.
+func exitStatus(err error) string {
+	if err == nil {
+		return "exit status 0"
+	}
+	return err.Error()
+}
+
+// appiumPort returns the appium port leased to the device, empty if none.
+func appiumPort(udid string) string {
+	lease, _ := ports.Lookup(udid)
+	return lease.Port(ports.Appium)
+}
+
+// freeAppiumPort returns the appium port leased to the device, leasing another one when other software is bound to it.
+func freeAppiumPort(udid string) (string, error) {
+	port := appiumPort(udid)
+	if port == "" {
+		return "", fmt.Errorf("no appium port assigned to device %s", udid)
+	}
+	if common.IsPortAvailable(port) {
+		return port, nil
+	}
+	lease, err := ports.Conflict(udid, ports.Appium)
+	if err != nil {
+		return "", err
+	}
+	return lease.Port(ports.Appium), nil
+}
+
+// startAppium starts a supervised appium server for the given UDID and test ID and returns its port.
+// With the appium pool enabled the warm server of the device is reused when it is healthy.
+func startAppium(udid, testId string) (string, error) {
+	appiumLogs := fmt.Sprintf("%s/%s.log", common.AppDirs.AppiumLogs, testId)
+	os.Remove(appiumLogs)
+	if server, ok := appiumPool.checkout(udid, appiumLogs); ok {
+		log.Printf("appium :: reusing warm server for %s on port %s\n", udid, server.port)
+		AppiumServers.Store(udid, server)
+		return server.port, nil
+	}
+
+	stopAppium(udid)
+	port, err := freeAppiumPort(udid)
+	if err != nil {
+		return "", err
+	}
+
+	server := newAppiumServer(udid, port, appiumLogs)
+	AppiumServers.Store(udid, server)
+	if err := server.start(); err != nil {
+		stopAppium(udid)
+		return "", err
+	}
+	return port, nil
+}
+
+// stopAppium stops the appium server for the given UDID, or hands a warm server back to the pool.
+func stopAppium(udid string) {
+	if server, ok := AppiumServers.LoadAndDelete(udid); ok {
+		if !appiumPool.release(udid) {
+			server.(*appiumServer).stop()
+		}
+		return
+	}
+}
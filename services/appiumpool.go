@@ -0,0 +1,296 @@
+package services
+
+import (
+	"byod/common"
+	"byod/registry"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	appiumPoolInterval = 30 * time.Second // interval between two pool maintenance rounds
+	primeTimeout       = 5 * time.Minute  // maximum time for the priming session, covers driver installation
+)
+
+// appiumPool keeps a warm appium server per ready device that new sessions reuse.
+var appiumPool = &warmPool{idle: make(map[string]*warmAppium), busy: make(map[string]*warmAppium)}
+
+// warmAppium is an appium server kept warm for one device.
+type warmAppium struct {
+	server   *appiumServer
+	platform string
+	sessions int           // sessions served since the server was started
+	ready    chan struct{} // closed once warming finished
+	err      error         // warming error, valid after ready is closed
+
+	testLog   string // per test log the server output of the current session is copied to
+	logOffset int64  // size of the server log when the current session started
+}
+
+// warmPool tracks idle warm servers and the ones lent to a running session.
+type warmPool struct {
+	mu           sync.Mutex
+	enabled      bool
+	recycleAfter int
+	idle         map[string]*warmAppium
+	busy         map[string]*warmAppium
+}
+
+// SetAppiumPool enables warm appium servers, recycled after the given number of sessions.
+func SetAppiumPool(enabled bool, recycleAfter int) {
+	appiumPool.mu.Lock()
+	defer appiumPool.mu.Unlock()
+	appiumPool.enabled = enabled
+	appiumPool.recycleAfter = recycleAfter
+}
+
+// isEnabled reports whether sessions are served by warm appium servers.
+func (p *warmPool) isEnabled() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.enabled
+}
+
+// AppiumPoolCron keeps a healthy warm appium server on every ready and idle device.
+func AppiumPoolCron(stopChan chan struct{}) {
+	if !appiumPool.isEnabled() {
+		return
+	}
+	for {
+		select {
+		case <-stopChan:
+			appiumPool.drain()
+			return
+		case <-time.After(appiumPoolInterval):
+			appiumPool.maintain()
+		}
+	}
+}
+
+// maintain discards unhealthy or orphaned warm servers and warms the ready devices without one.
+func (p *warmPool) maintain() {
+	ready := make(map[string]common.DeviceInfo)
+	for _, device := range registry.List(registry.ByState(common.StateReady)) {
+		ready[device.UDID] = device
+	}
+
+	p.mu.Lock()
+	idle := make(map[string]*warmAppium, len(p.idle))
+	for udid, warm := range p.idle {
+		if isClosed(warm.ready) {
+			idle[udid] = warm
+		}
+	}
+	p.mu.Unlock()
+
+	// probe outside the lock, a session may check the server out meanwhile
+	var discard []*warmAppium
+	for udid, warm := range idle {
+		_, isReady := ready[udid]
+		if isReady && warm.healthy() {
+			continue
+		}
+		p.mu.Lock()
+		if p.idle[udid] == warm {
+			delete(p.idle, udid)
+			discard = append(discard, warm)
+		}
+		p.mu.Unlock()
+	}
+
+	p.mu.Lock()
+	var warmUp []common.DeviceInfo
+	for udid, device := range ready {
+		_, isIdle := p.idle[udid]
+		_, isBusy := p.busy[udid]
+		if _, locked := DeviceLocks.owner(udid); !isIdle && !isBusy && !locked {
+			warmUp = append(warmUp, device)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, warm := range discard {
+		log.Printf("appiumPool :: discarding warm server for %s\n", warm.server.udid)
+		warm.server.stop()
+	}
+	for _, device := range warmUp {
+		p.warm(device.UDID, device.OS)
+	}
+}
+
+// warm starts and primes a server for the device in the background.
+func (p *warmPool) warm(udid, platform string) {
+	port, err := freeAppiumPort(udid)
+	if err != nil {
+		log.Printf("appiumPool :: no port to warm %s: %v\n", udid, err)
+		return
+	}
+	warm := &warmAppium{
+		server:   newAppiumServer(udid, port, fmt.Sprintf("%s/warm_%s.log", common.AppDirs.AppiumLogs, udid)),
+		platform: platform,
+		ready:    make(chan struct{}),
+	}
+	p.mu.Lock()
+	p.idle[udid] = warm
+	p.mu.Unlock()
+
+	go func() {
+		os.Remove(warm.server.logPath)
+		warm.err = warm.server.start()
+		if warm.err == nil {
+			warm.err = primeAppium(warm.server, platform)
+		}
+		close(warm.ready)
+		if warm.err != nil {
+			log.Printf("appiumPool :: warming %s failed: %v\n", udid, warm.err)
+			return
+		}
+		log.Printf("appiumPool :: warm server ready for %s on port %s\n", udid, port)
+	}()
+}
+
+// checkout lends the warm server of the device to a session, waiting for warming in progress.
+func (p *warmPool) checkout(udid, testLog string) (*appiumServer, bool) {
+	p.mu.Lock()
+	warm, ok := p.idle[udid]
+	delete(p.idle, udid)
+	p.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	<-warm.ready
+	if warm.err != nil || !warm.healthy() {
+		warm.server.stop()
+		return nil, false
+	}
+	warm.testLog = testLog
+	warm.logOffset = fileSize(warm.server.logPath)
+
+	p.mu.Lock()
+	p.busy[udid] = warm
+	p.mu.Unlock()
+	return warm.server, true
+}
+
+// release takes the server back from a finished session and recycles it when worn out or broken.
+// It reports false when the device had no warm server lent out.
+func (p *warmPool) release(udid string) bool {
+	p.mu.Lock()
+	warm, ok := p.busy[udid]
+	delete(p.busy, udid)
+	recycleAfter := p.recycleAfter
+	p.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	if err := copyLogTail(warm.server.logPath, warm.logOffset, warm.testLog); err != nil {
+		log.Printf("appiumPool :: unable to save appium log of %s: %v\n", udid, err)
+	}
+	warm.sessions++
+	switch {
+	case warm.server.crashed():
+		log.Printf("appiumPool :: recycling crashed server for %s\n", udid)
+	case recycleAfter > 0 && warm.sessions >= recycleAfter:
+		log.Printf("appiumPool :: recycling server for %s after %d sessions\n", udid, warm.sessions)
+	case !warm.healthy():
+		log.Printf("appiumPool :: recycling unresponsive server for %s\n", udid)
+	default:
+		p.mu.Lock()
+		p.idle[udid] = warm
+		p.mu.Unlock()
+		return true
+	}
+	warm.server.stop()
+	return true
+}
+
+// drain stops every idle warm server.
+func (p *warmPool) drain() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = make(map[string]*warmAppium)
+	p.mu.Unlock()
+	for _, warm := range idle {
+		warm.server.stop()
+	}
+}
+
+// healthy reports whether the server process runs and answers its status endpoint.
+func (w *warmAppium) healthy() bool {
+	if !w.server.alive() || w.server.crashed() {
+		return false
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	ready, _ := probeAppium(client, fmt.Sprintf("http://localhost:%s/wd/hub/status", w.server.port))
+	return ready
+}
+
+// primeAppium opens and quits a session on the server so the driver is installed and started before the first test.
+// The session gets the leased ports and host capabilities of real sessions, so the driver is not started again for them.
+func primeAppium(server *appiumServer, platform string) error {
+	_, hostPorts, err := devicePorts(server.udid, platform)
+	if err != nil {
+		return err
+	}
+	payload, err := mergeHostCapabilities([]byte(`{"capabilities":{"alwaysMatch":{"appium:newCommandTimeout":60},"firstMatch":[{}]}}`), server.udid, platform, hostPorts)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: primeTimeout}
+	baseURL := fmt.Sprintf("http://localhost:%s/wd/hub/session", server.port)
+	resp, err := client.Post(baseURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("priming session failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var created newSessionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil || created.Value.SessionID == "" {
+		return fmt.Errorf("priming session not created: %s", resp.Status)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, baseURL+"/"+created.Value.SessionID, nil)
+	deleted, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("priming session not deleted: %v", err)
+	}
+	deleted.Body.Close()
+	return nil
+}
+
+// fileSize returns the size of the file, or zero when it cannot be read.
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// copyLogTail writes everything after offset in the source file to the destination file.
+func copyLogTail(source string, offset int64, destination string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if _, err := in.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	out, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
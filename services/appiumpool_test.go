@@ -0,0 +1,42 @@
+package services
+
+import (
+	"byod/ports"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestPrimingSessionUsesLeasedPorts(t *testing.T) {
+	var capabilities map[string]interface{}
+	appium := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			var payload struct {
+				Capabilities struct {
+					AlwaysMatch map[string]interface{} `json:"alwaysMatch"`
+				} `json:"capabilities"`
+			}
+			json.NewDecoder(r.Body).Decode(&payload)
+			capabilities = payload.Capabilities.AlwaysMatch
+		}
+		w.Write([]byte(`{"value":{"sessionId":"prime-1"}}`))
+	}))
+	defer appium.Close()
+	target, _ := url.Parse(appium.URL)
+	t.Cleanup(func() { ports.Release("ios-prime") })
+
+	if err := primeAppium(&appiumServer{udid: "ios-prime", port: target.Port()}, "ios"); err != nil {
+		t.Fatal(err)
+	}
+	lease, _ := ports.Lookup("ios-prime")
+	for name, port := range map[string]int{capWdaLocalPort: lease.Ports[ports.WDA], capMjpegServerPort: lease.Ports[ports.MJPEG]} {
+		if capabilities[name] != float64(port) {
+			t.Errorf("priming session %s = %v, want the leased port %d", name, capabilities[name], port)
+		}
+	}
+	if capabilities[capUDID] != "ios-prime" || capabilities[capAutomationName] != "XCUITest" {
+		t.Errorf("priming session without host capabilities %v", capabilities)
+	}
+}
@@ -2,6 +2,9 @@ package services
 
 import (
 	"byod/common"
+	"byod/provider"
+	"byod/quarantine"
+	"byod/registry"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -18,17 +21,10 @@ type RequestInfo struct {
 	Action  string `json:"action"`
 }
 
-// AppInfo represents the structure for a single application.
-type AppInfo struct {
-	Name    string `json:"name"`
-	Package string `json:"package"`
-	Version string `json:"version"`
-}
-
 // AppResponse represents the JSON structure for outgoing responses.
 type AppResponse struct {
-	Status string    `json:"status"`
-	Apps   []AppInfo `json:"apps"`
+	Status string           `json:"status"`
+	Apps   []common.AppInfo `json:"apps"`
 }
 
 // ApplicationHandler handles different application actions such as install, uninstall, etc.
@@ -39,6 +35,13 @@ func ApplicationHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	os, status := attachedDeviceOS(requestInfo.UDID, requestInfo.OS)
+	if status != http.StatusOK {
+		http.Error(w, `{"status":"invalid device"}`, status)
+		return
+	}
+	requestInfo.OS = os
+
 	log.Println("action", requestInfo.Action, "os", requestInfo.OS, "udid", requestInfo.UDID, "appPath", requestInfo.AppPath, "package", requestInfo.Package)
 	var response AppResponse
 	switch requestInfo.Action {
@@ -71,103 +74,83 @@ func executeAppAction(err error) string {
 	return "success"
 }
 
+// attachedDeviceOS returns the OS of an attached device from the registry, with the HTTP status to reply
+// when the device is unknown or the request claims another OS.
+func attachedDeviceOS(udid, claimed string) (string, int) {
+	device, ok := registry.Get(udid)
+	if !ok {
+		return "", http.StatusNotFound
+	}
+	if claimed != "" && !strings.EqualFold(claimed, device.OS) {
+		return "", http.StatusBadRequest
+	}
+	return device.OS, http.StatusOK
+}
+
+// deviceProvider returns the provider serving devices of the OS.
+func deviceProvider(os string) (provider.DeviceProvider, error) {
+	p, ok := provider.Get(os)
+	if !ok {
+		return nil, fmt.Errorf("unsupported os %q", os)
+	}
+	return p, nil
+}
+
 // installApp installs an app on a device identified by OS and UDID.
 func installApp(os, udid, appPath string) error {
+	p, err := deviceProvider(os)
+	if err != nil {
+		return err
+	}
 	filePath, err := common.DownloadAppIfRequired(appPath)
 	if err != nil {
 		return err
 	}
-	var command string
-	if os == "android" {
-		command = fmt.Sprintf("%s -s %s install -t %s", common.Adb, udid, filePath)
-	} else {
-		command = fmt.Sprintf("%s install --path=%s --udid %s", common.GoIOS, filePath, udid)
+	if err := p.InstallApp(udid, filePath); err != nil {
+		quarantine.Record(udid, quarantine.InstallFailed)
+		return err
 	}
-	_, err = common.Execute(command)
-	return err
+	quarantine.Record(udid, quarantine.AppInstalled)
+	return nil
 }
 
 // uninstallApp uninstalls an app from a device.
 func uninstallApp(os, udid, bundle string) error {
-	var command string
-	if os == "android" {
-		command = fmt.Sprintf("%s -s %s uninstall %s", common.Adb, udid, bundle)
-	} else {
-		command = fmt.Sprintf("%s uninstall %s --udid %s", common.GoIOS, bundle, udid)
-	}
-	_, err := common.Execute(command)
-	return err
+	p, err := deviceProvider(os)
+	if err != nil {
+		return err
+	}
+	return p.UninstallApp(udid, bundle)
 }
 
 // launchApp launches an app on a device.
 func launchApp(os, udid, bundle string) error {
-	var command string
-	if os == "android" {
-		command = fmt.Sprintf("%s -s %s shell monkey -p %s -c android.intent.category.LAUNCHER 1", common.Adb, udid, bundle)
-	} else {
-		command = fmt.Sprintf("%s launch %s --udid %s", common.GoIOS, bundle, udid)
-	}
-	_, err := common.Execute(command)
-	return err
+	p, err := deviceProvider(os)
+	if err != nil {
+		return err
+	}
+	return p.LaunchApp(udid, bundle)
 }
 
 // killApp force-stops an app on a device.
 func killApp(os, udid, bundle string) error {
-	var command string
-	if os == "android" {
-		command = fmt.Sprintf("%s -s %s shell am force-stop %s", common.Adb, udid, bundle)
-	} else {
-		command = fmt.Sprintf("%s kill %s --udid %s", common.GoIOS, bundle, udid)
-	}
-	_, err := common.Execute(command)
-	return err
+	p, err := deviceProvider(os)
+	if err != nil {
+		return err
+	}
+	return p.KillApp(udid, bundle)
 }
 
 // ListApps lists all installed apps on a device.
-func ListApps(os, udid string) []AppInfo {
-	var appList []AppInfo
-	if os == "android" {
-		command := fmt.Sprintf("%s -s %s shell 'pm list packages -3 | cut -d ':' -f2 | while read line; do version=`dumpsys package $line | grep versionName | cut -d '=' -f2`; echo \"$line $version\"; done'", common.Adb, udid)
-		output, err := common.Execute(command)
-		if err == nil {
-			apps := strings.Split(output, "\n")
-			for _, app := range apps {
-				appInfo := strings.Split(app, " ")
-				appList = append(appList, AppInfo{
-					Package: appInfo[0],
-					Version: appInfo[1],
-				})
-			}
-			return appList
-		}
+func ListApps(os, udid string) []common.AppInfo {
+	p, err := deviceProvider(os)
+	if err != nil {
+		log.Println("error while getting app list", err)
+		return nil
+	}
+	appList, err := p.ListApps(udid)
+	if err != nil {
 		log.Println("error while getting app list", err)
-	} else {
-		command := fmt.Sprintf("%s apps --list --udid %s", common.GoIOS, udid)
-		output, err := common.Execute(command)
-		if err == nil {
-			apps := strings.Split(output, "\n")
-			for _, app := range apps {
-				appInfo := strings.Split(app, " ")
-				appList = append(appList, AppInfo{
-					Name:    appInfo[1],
-					Package: appInfo[0],
-					Version: appInfo[2],
-				})
-			}
-			return appList
-		}
 	}
 	return appList
 }
-
-// parseAppList parses the command line output into a slice of AppInfo.
-func parseAppList(output string) []AppInfo {
-	var apps []AppInfo
-	for _, line := range strings.Split(output, "\n") {
-		parts := strings.Split(line, " ")
-		if len(parts) >= 3 {
-			apps = append(apps, AppInfo{Name: parts[1], Package: parts[0], Version: parts[2]})
-		}
-	}
-	return apps
-}
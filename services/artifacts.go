@@ -0,0 +1,145 @@
+package services
+
+import (
+	"byod/common"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Artifact describes a file produced by a test.
+type Artifact struct {
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	path     string
+}
+
+// ArtifactsResponse represents the JSON structure of artifact listings.
+type ArtifactsResponse struct {
+	Status    string     `json:"status"`
+	TestID    string     `json:"testId"`
+	Artifacts []Artifact `json:"artifacts"`
+}
+
+// ArtifactsHandler lists the artifacts of a test or streams one of them.
+// Only the user who ran the test and admins of the same organization may access them.
+func ArtifactsHandler(w http.ResponseWriter, r *http.Request, testID, name string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, `{"status":"method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	if !isSafeName(testID) || (name != "" && !isSafeName(name)) {
+		http.Error(w, `{"status":"invalid artifact"}`, http.StatusBadRequest)
+		return
+	}
+
+	owner, err := readTestOwner(testID)
+	if err != nil {
+		http.Error(w, `{"status":"test not found"}`, http.StatusNotFound)
+		return
+	}
+	if !canAccessTest(requestUser(r), owner) {
+		http.Error(w, `{"status":"forbidden"}`, http.StatusForbidden)
+		return
+	}
+
+	artifacts := listArtifacts(testID)
+	if name == "" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(ArtifactsResponse{Status: "success", TestID: testID, Artifacts: artifacts}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	for _, artifact := range artifacts {
+		if artifact.Name == name {
+			serveArtifact(w, r, artifact)
+			return
+		}
+	}
+	http.Error(w, `{"status":"artifact not found"}`, http.StatusNotFound)
+}
+
+// serveArtifact streams an artifact file, honouring Range requests.
+func serveArtifact(w http.ResponseWriter, r *http.Request, artifact Artifact) {
+	file, err := os.Open(artifact.path)
+	if err != nil {
+		http.Error(w, `{"status":"artifact not found"}`, http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	if strings.HasSuffix(artifact.Name, ".jsonl") {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Content-Disposition", "inline; filename=\""+artifact.Name+"\"")
+	http.ServeContent(w, r, artifact.Name, artifact.Modified, file)
+}
+
+// listArtifacts collects the files of a test from the artifact directories.
+func listArtifacts(testID string) []Artifact {
+	candidates := []struct{ name, kind, path string }{
+		{"test.json", "test", filepath.Join(common.AppDirs.TestInfo, testID+".json")},
+		{"appium.log", "appium-log", filepath.Join(common.AppDirs.AppiumLogs, testID+".log")},
+		{"commands.jsonl", "command-log", filepath.Join(common.AppDirs.CommandLogs, testID+".jsonl")},
+		{"video.mp4", "video", filepath.Join(common.AppDirs.Videos, testID+".mp4")},
+	}
+	screenshots, _ := filepath.Glob(filepath.Join(common.AppDirs.Screenshots, testID+"_*.png"))
+	sort.Strings(screenshots)
+	for _, path := range screenshots {
+		candidates = append(candidates, struct{ name, kind, path string }{filepath.Base(path), "screenshot", path})
+	}
+
+	artifacts := []Artifact{}
+	for _, candidate := range candidates {
+		info, err := os.Stat(candidate.path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		artifacts = append(artifacts, Artifact{
+			Name:     candidate.name,
+			Type:     candidate.kind,
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+			path:     candidate.path,
+		})
+	}
+	return artifacts
+}
+
+// readTestOwner returns the owner stored in the test record.
+func readTestOwner(testID string) (testOwner, error) {
+	data, err := os.ReadFile(filepath.Join(common.AppDirs.TestInfo, testID+".json"))
+	if err != nil {
+		return testOwner{}, err
+	}
+	var record testRecordData
+	if err := json.Unmarshal(data, &record); err != nil {
+		return testOwner{}, err
+	}
+	return record.Owner, nil
+}
+
+// canAccessTest allows the owner of a test and admins of the owner's organization.
+func canAccessTest(user common.UserDetails, owner testOwner) bool {
+	if user.UserID != 0 && user.UserID == owner.UserID {
+		return true
+	}
+	return isOrgAdmin(user) && user.OrgID == owner.OrgID
+}
+
+// isOrgAdmin reports whether the user administers their organization.
+func isOrgAdmin(user common.UserDetails) bool {
+	return strings.EqualFold(user.Role, "admin")
+}
+
+// isSafeName rejects path segments that could escape the artifact directories.
+func isSafeName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
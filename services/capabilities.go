@@ -0,0 +1,343 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Capabilities understood by the binary itself rather than appium.
+const (
+	capQueueTimeout = "lt:queueTimeout" // seconds to wait for a busy device, 0 fails immediately
+	capUDID         = "appium:udid"
+)
+
+// Capabilities controlled by the host, whatever the client asks for.
+const (
+	capAutomationName        = "appium:automationName"
+	capNewCommandTimeout     = "appium:newCommandTimeout"
+	defaultMaxCommandTimeout = 7200
+)
+
+// Port capabilities allocated by the host.
+const (
+	capSystemPort       = "appium:systemPort"
+	capWdaLocalPort     = "appium:wdaLocalPort"
+	capMjpegServerPort  = "appium:mjpegServerPort"
+	capChromedriverPort = "appium:chromedriverPort"
+)
+
+// hostPortCapabilities are allocated by the host and never taken from the client.
+var hostPortCapabilities = []string{
+	capSystemPort,
+	capWdaLocalPort,
+	capMjpegServerPort,
+	capChromedriverPort,
+	"appium:webkitDebugProxyPort",
+}
+
+// defaultForbiddenCapabilities point appium at host binaries or paths and are rejected.
+var defaultForbiddenCapabilities = []string{
+	"appium:chromedriverExecutable",
+	"appium:chromedriverExecutableDir",
+	"appium:chromedriverChromeMappingFile",
+	"appium:keystorePath",
+	"appium:derivedDataPath",
+	"appium:xcodeConfigFile",
+	"appium:xcodeOrgId",
+	"appium:xcodeSigningId",
+	"appium:updatedWDABundleId",
+	"appium:webDriverAgentUrl",
+	"appium:agentPath",
+	"appium:bootstrapPath",
+	"appium:remoteAdbHost",
+	"appium:adbPort",
+	"appium:avd",
+}
+
+// CapabilityPolicy holds the lab wide capability defaults and limits applied to every session.
+type CapabilityPolicy struct {
+	Defaults             map[string]map[string]interface{} `json:"defaults"`  // platform -> capabilities set when absent
+	Devices              map[string]map[string]interface{} `json:"devices"`   // udid -> capabilities set when absent
+	Forbidden            []string                          `json:"forbidden"` // rejected in addition to the built-in list
+	MaxNewCommandTimeout float64                           `json:"maxNewCommandTimeout"`
+}
+
+var capabilityPolicy = CapabilityPolicy{MaxNewCommandTimeout: defaultMaxCommandTimeout}
+
+// LoadCapabilityPolicy reads the capability policy from a JSON file.
+func LoadCapabilityPolicy(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	policy := CapabilityPolicy{MaxNewCommandTimeout: defaultMaxCommandTimeout}
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return fmt.Errorf("invalid capability policy %s: %v", path, err)
+	}
+	capabilityPolicy = policy
+	log.Printf("loaded capability policy from %s\n", path)
+	return nil
+}
+
+// sessionRequest is a new-session payload in either the W3C or the legacy JSONWP shape.
+type sessionRequest struct {
+	Capabilities struct {
+		AlwaysMatch map[string]interface{}   `json:"alwaysMatch"`
+		FirstMatch  []map[string]interface{} `json:"firstMatch"`
+	} `json:"capabilities"`
+	DesiredCapabilities map[string]interface{} `json:"desiredCapabilities"`
+}
+
+// parseSessionRequest decodes the capabilities of a new-session payload.
+func parseSessionRequest(body []byte) (sessionRequest, error) {
+	var request sessionRequest
+	if len(body) == 0 {
+		return request, nil
+	}
+	err := json.Unmarshal(body, &request)
+	return request, err
+}
+
+// capability looks a capability up in alwaysMatch, the first firstMatch entry and desiredCapabilities, in that order.
+func (r sessionRequest) capability(name string) (interface{}, bool) {
+	if value, ok := r.Capabilities.AlwaysMatch[name]; ok {
+		return value, true
+	}
+	if len(r.Capabilities.FirstMatch) > 0 {
+		if value, ok := r.Capabilities.FirstMatch[0][name]; ok {
+			return value, true
+		}
+	}
+	value, ok := r.DesiredCapabilities[name]
+	return value, ok
+}
+
+// stringCapability returns a capability value if it is a string.
+func (r sessionRequest) stringCapability(name string) string {
+	value, _ := r.capability(name)
+	str, _ := value.(string)
+	return str
+}
+
+// boolCapability reports whether a capability is set to true.
+func (r sessionRequest) boolCapability(name string) bool {
+	value, _ := r.capability(name)
+	enabled, _ := value.(bool)
+	return enabled
+}
+
+// queueTimeout returns how long the client is willing to wait for a busy device.
+func (r sessionRequest) queueTimeout() time.Duration {
+	value, ok := r.capability(capQueueTimeout)
+	if !ok {
+		return 0
+	}
+	seconds, ok := value.(float64)
+	if !ok || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// capabilityError is a capability problem reported to the client as a W3C error.
+type capabilityError struct {
+	code    string
+	message string
+}
+
+func (e *capabilityError) Error() string {
+	return e.message
+}
+
+// capabilitySets gives access to every capability set of a new-session payload while keeping unknown fields intact.
+type capabilitySets struct {
+	payload     map[string]interface{}
+	alwaysMatch map[string]interface{}   // nil when the payload has no W3C capabilities
+	firstMatch  []map[string]interface{} // W3C firstMatch entries
+	desired     map[string]interface{}   // nil when the payload has no JSONWP capabilities
+}
+
+// parseCapabilitySets decodes a new-session payload and checks its W3C structure.
+func parseCapabilitySets(body []byte) (*capabilitySets, error) {
+	sets := &capabilitySets{}
+	if err := json.Unmarshal(body, &sets.payload); err != nil || sets.payload == nil {
+		return nil, &capabilityError{"invalid argument", "new session payload must be a JSON object"}
+	}
+
+	if raw, ok := sets.payload["capabilities"]; ok {
+		capabilities, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, &capabilityError{"invalid argument", "capabilities must be a JSON object"}
+		}
+		sets.alwaysMatch = make(map[string]interface{})
+		if raw, ok := capabilities["alwaysMatch"]; ok && raw != nil {
+			if sets.alwaysMatch, ok = raw.(map[string]interface{}); !ok {
+				return nil, &capabilityError{"invalid argument", "alwaysMatch must be a JSON object"}
+			}
+		}
+		capabilities["alwaysMatch"] = sets.alwaysMatch
+
+		if raw, ok := capabilities["firstMatch"]; ok && raw != nil {
+			entries, ok := raw.([]interface{})
+			if !ok {
+				return nil, &capabilityError{"invalid argument", "firstMatch must be a JSON array"}
+			}
+			for _, entry := range entries {
+				set, ok := entry.(map[string]interface{})
+				if !ok {
+					return nil, &capabilityError{"invalid argument", "firstMatch entries must be JSON objects"}
+				}
+				for name := range set {
+					if _, dup := sets.alwaysMatch[name]; dup {
+						return nil, &capabilityError{"invalid argument", fmt.Sprintf("capability %s appears in both alwaysMatch and firstMatch", name)}
+					}
+				}
+				sets.firstMatch = append(sets.firstMatch, set)
+			}
+		}
+	}
+
+	if raw, ok := sets.payload["desiredCapabilities"]; ok && raw != nil {
+		desired, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, &capabilityError{"invalid argument", "desiredCapabilities must be a JSON object"}
+		}
+		sets.desired = desired
+	}
+
+	if sets.alwaysMatch == nil && sets.desired == nil {
+		return nil, &capabilityError{"invalid argument", "new session payload has no capabilities"}
+	}
+	return sets, nil
+}
+
+// each calls fn for every capability set of the payload.
+func (c *capabilitySets) each(fn func(set map[string]interface{})) {
+	if c.alwaysMatch != nil {
+		fn(c.alwaysMatch)
+	}
+	for _, set := range c.firstMatch {
+		fn(set)
+	}
+	if c.desired != nil {
+		fn(c.desired)
+	}
+}
+
+// sameCapability reports whether two capability names are equal once the appium: prefix is dropped, appium reads both spellings.
+func sameCapability(a, b string) bool {
+	return strings.TrimPrefix(a, "appium:") == strings.TrimPrefix(b, "appium:")
+}
+
+// has reports whether any capability set contains the capability, with or without the appium: prefix.
+func (c *capabilitySets) has(name string) bool {
+	found := false
+	c.each(func(set map[string]interface{}) {
+		for key := range set {
+			if sameCapability(key, name) {
+				found = true
+			}
+		}
+	})
+	return found
+}
+
+// force sets the capability for every match, replacing any client supplied value.
+func (c *capabilitySets) force(name string, value interface{}) {
+	c.remove(name)
+	if c.alwaysMatch != nil {
+		c.alwaysMatch[name] = value
+	}
+	if c.desired != nil {
+		c.desired[name] = value
+	}
+}
+
+// setDefault sets the capability only if the client did not supply it.
+func (c *capabilitySets) setDefault(name string, value interface{}) {
+	if !c.has(name) {
+		c.force(name, value)
+	}
+}
+
+// remove deletes the capability from every set, in both spellings.
+func (c *capabilitySets) remove(name string) {
+	c.each(func(set map[string]interface{}) {
+		for key := range set {
+			if sameCapability(key, name) {
+				delete(set, key)
+			}
+		}
+	})
+}
+
+// clampNumber lowers every numeric value of the capability to max, values of 0 or less disable the limit and are raised to max.
+func (c *capabilitySets) clampNumber(name string, max float64) {
+	c.each(func(set map[string]interface{}) {
+		for key, raw := range set {
+			if value, ok := raw.(float64); ok && sameCapability(key, name) && (value > max || value <= 0) {
+				set[key] = max
+			}
+		}
+	})
+}
+
+// marshal encodes the payload with its modified capabilities.
+func (c *capabilitySets) marshal() ([]byte, error) {
+	return json.Marshal(c.payload)
+}
+
+// validateCapabilities rejects capabilities the client is not allowed to set.
+func validateCapabilities(sets *capabilitySets) error {
+	forbidden := append(append([]string{}, defaultForbiddenCapabilities...), capabilityPolicy.Forbidden...)
+	for _, name := range forbidden {
+		if sets.has(name) {
+			return &capabilityError{"invalid argument", fmt.Sprintf("capability %s is not allowed on this host", name)}
+		}
+	}
+	return nil
+}
+
+// applyHostCapabilities merges the policy defaults and forces the host controlled capabilities for the device.
+// Client port capabilities are dropped and replaced by the ports allocated by the host.
+func applyHostCapabilities(sets *capabilitySets, udid, platform string, hostPorts map[string]int) {
+	for name, value := range capabilityPolicy.Devices[udid] {
+		sets.setDefault(name, value)
+	}
+	for name, value := range capabilityPolicy.Defaults[platform] {
+		sets.setDefault(name, value)
+	}
+
+	sets.force(capUDID, udid)
+	if platform != "" {
+		sets.force(capPlatformName, platform)
+		sets.force(capAutomationName, automationNameFor(platform))
+	}
+	for _, name := range hostPortCapabilities {
+		sets.remove(name)
+	}
+	for name, port := range hostPorts {
+		sets.force(name, port)
+	}
+	sets.clampNumber(capNewCommandTimeout, capabilityPolicy.MaxNewCommandTimeout)
+}
+
+// automationNameFor returns the appium driver used for the platform.
+func automationNameFor(platform string) string {
+	if platform == "ios" {
+		return "XCUITest"
+	}
+	return "UiAutomator2"
+}
+
+// devicePlatform returns the platform of a device, preferring the watcher's view over the client's claim.
+func devicePlatform(udid, claimed string) string {
+	if device, ok := lookupDevice(udid); ok {
+		return device.OS
+	}
+	return strings.ToLower(claimed)
+}
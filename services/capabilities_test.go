@@ -0,0 +1,49 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnprefixedCapabilitiesAreChecked(t *testing.T) {
+	for _, body := range []string{
+		`{"desiredCapabilities":{"chromedriverExecutable":"/tmp/driver"}}`,
+		`{"capabilities":{"alwaysMatch":{},"firstMatch":[{"appium:chromedriverExecutable":"/tmp/driver"}]}}`,
+	} {
+		sets, err := parseCapabilitySets([]byte(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := validateCapabilities(sets); err == nil {
+			t.Errorf("forbidden capability accepted in %s", body)
+		}
+	}
+
+	sets, err := parseCapabilitySets([]byte(`{"capabilities":{"alwaysMatch":{"platformName":"android"},"firstMatch":[{"udid":"other","systemPort":8201}]},"desiredCapabilities":{"wdaLocalPort":8100}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyHostCapabilities(sets, "android-1", "android", map[string]int{capSystemPort: 8210})
+	body, _ := sets.marshal()
+	for _, leaked := range []string{`"udid"`, `"systemPort"`, `"wdaLocalPort"`, `8201`, `8100`} {
+		if strings.Contains(string(body), leaked) {
+			t.Errorf("client capability %s kept in %s", leaked, body)
+		}
+	}
+	if !strings.Contains(string(body), `"appium:systemPort":8210`) || !strings.Contains(string(body), `"appium:udid":"android-1"`) {
+		t.Errorf("host capabilities not forced in %s", body)
+	}
+}
+
+func TestNewCommandTimeoutIsClamped(t *testing.T) {
+	for _, timeout := range []string{"0", "-1", "86400"} {
+		sets, err := parseCapabilitySets([]byte(`{"capabilities":{"alwaysMatch":{"newCommandTimeout":` + timeout + `}}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		applyHostCapabilities(sets, "android-1", "android", nil)
+		if got := sets.alwaysMatch["newCommandTimeout"]; got != float64(defaultMaxCommandTimeout) {
+			t.Errorf("newCommandTimeout %s clamped to %v, want %d", timeout, got, defaultMaxCommandTimeout)
+		}
+	}
+}
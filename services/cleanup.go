@@ -0,0 +1,153 @@
+package services
+
+import (
+	"byod/common"
+	"byod/provider"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// CleanupProfile lists what is restored on a device after every session.
+type CleanupProfile struct {
+	UninstallThirdParty bool     `json:"uninstallThirdParty"` // uninstall every user installed app missing from Allowlist
+	Allowlist           []string `json:"allowlist"`           // apps kept on the device, a trailing * matches a prefix
+	ClearData           []string `json:"clearData"`           // apps whose data is deleted
+	KillApps            []string `json:"killApps"`            // apps stopped
+	PressHome           bool     `json:"pressHome"`           // return to the home screen, closing dialogs
+	ResetRotation       bool     `json:"resetRotation"`       // lock the screen in portrait
+	Locale              string   `json:"locale"`              // locale set on the device, such as en_US
+	RemoveFiles         []string `json:"removeFiles"`         // files and directories deleted from the device storage
+}
+
+// CleanupPolicy selects the cleanup profile of every device.
+type CleanupPolicy struct {
+	Profiles  map[string]CleanupProfile `json:"profiles"`
+	Default   string                    `json:"default"`   // profile of the devices without their own, empty skips cleanup
+	Platforms map[string]string         `json:"platforms"` // platform -> profile
+	Devices   map[string]string         `json:"devices"`   // udid -> profile
+}
+
+var cleanupPolicy CleanupPolicy
+
+// protectedApps are the drivers installed by the host and appium, never uninstalled by a cleanup.
+var protectedApps = []string{
+	"io.appium.settings",
+	"io.appium.uiautomator2.server*",
+	"com.facebook.WebDriverAgentRunner*",
+}
+
+// LoadCleanupPolicy reads the cleanup profiles from a JSON file.
+func LoadCleanupPolicy(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var policy CleanupPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return fmt.Errorf("invalid cleanup policy %s: %v", path, err)
+	}
+	selected := []string{policy.Default}
+	for _, name := range policy.Platforms {
+		selected = append(selected, name)
+	}
+	for _, name := range policy.Devices {
+		selected = append(selected, name)
+	}
+	for _, name := range selected {
+		if _, ok := policy.Profiles[name]; name != "" && !ok {
+			return fmt.Errorf("invalid cleanup policy %s: unknown profile %q", path, name)
+		}
+	}
+	cleanupPolicy = policy
+	log.Printf("loaded cleanup policy from %s\n", path)
+	return nil
+}
+
+// profileFor returns the cleanup profile of the device and its name, the device profile first, then the platform one.
+func (p CleanupPolicy) profileFor(device common.DeviceInfo) (CleanupProfile, string, bool) {
+	name := p.Default
+	if platform, ok := p.Platforms[device.OS]; ok {
+		name = platform
+	}
+	if own, ok := p.Devices[device.UDID]; ok {
+		name = own
+	}
+	profile, ok := p.Profiles[name]
+	return profile, name, ok
+}
+
+// cleanDevice runs the cleanup profile of the device and reports the steps that failed.
+// Steps the platform cannot perform are skipped and logged together, once per cleanup.
+func cleanDevice(device common.DeviceInfo) error {
+	profile, name, ok := cleanupPolicy.profileFor(device)
+	if !ok {
+		return nil
+	}
+	p, err := deviceProvider(device.OS)
+	if err != nil {
+		return err
+	}
+	started := time.Now()
+	var failures, skipped []string
+	step := func(what string, err error) {
+		switch {
+		case err == nil:
+		case errors.Is(err, provider.ErrUnsupported):
+			skipped = append(skipped, what)
+		default:
+			failures = append(failures, fmt.Sprintf("%s: %v", what, err))
+		}
+	}
+
+	for _, bundle := range profile.KillApps {
+		step("kill "+bundle, p.KillApp(device.UDID, bundle))
+	}
+	for _, bundle := range profile.ClearData {
+		step("clear "+bundle, p.ClearAppData(device.UDID, bundle))
+	}
+	if profile.UninstallThirdParty {
+		apps, err := p.ListApps(device.UDID)
+		step("list apps", err)
+		for _, app := range apps {
+			if !matchesApp(app.Package, protectedApps) && !matchesApp(app.Package, profile.Allowlist) {
+				step("uninstall "+app.Package, p.UninstallApp(device.UDID, app.Package))
+			}
+		}
+	}
+	for _, path := range profile.RemoveFiles {
+		step("remove "+path, p.RemoveFiles(device.UDID, path))
+	}
+	if profile.Locale != "" {
+		step("locale "+profile.Locale, p.SetLocale(device.UDID, profile.Locale))
+	}
+	if profile.ResetRotation {
+		step("reset rotation", p.ResetRotation(device.UDID))
+	}
+	if profile.PressHome {
+		step("press home", p.PressHome(device.UDID))
+	}
+
+	if len(skipped) > 0 {
+		log.Printf("cleanDevice :: skipped on %s, %v: %s\n", device.UDID, provider.ErrUnsupported, strings.Join(skipped, ", "))
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	log.Printf("cleanDevice :: %s cleaned with profile %s in %v\n", device.UDID, name, time.Since(started).Round(time.Millisecond))
+	return nil
+}
+
+// matchesApp reports whether the bundle is in the list, entries ending with * match a prefix.
+func matchesApp(bundle string, list []string) bool {
+	for _, entry := range list {
+		if prefix, wildcard := strings.CutSuffix(entry, "*"); wildcard && strings.HasPrefix(bundle, prefix) || entry == bundle {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"byod/common"
+	"byod/provider"
+	"byod/registry"
+	"fmt"
+	"testing"
+)
+
+func TestCleanDeviceRunsProfile(t *testing.T) {
+	fake := provider.NewFake("android")
+	provider.Register(fake)
+	fake.Attach(common.DeviceInfo{UDID: "android-1"})
+	for _, app := range []string{"com.team.app", "com.lab.vpn", "io.appium.uiautomator2.server.test"} {
+		fake.InstallApp("android-1", app)
+	}
+	cleanupPolicy = CleanupPolicy{
+		Default: "standard",
+		Profiles: map[string]CleanupProfile{"standard": {
+			UninstallThirdParty: true,
+			Allowlist:           []string{"com.lab.*"},
+			ClearData:           []string{"com.android.chrome"},
+			KillApps:            []string{"com.android.chrome"},
+			PressHome:           true,
+			Locale:              "en_US",
+			RemoveFiles:         []string{"/sdcard/Download"},
+		}},
+	}
+	t.Cleanup(func() { cleanupPolicy = CleanupPolicy{} })
+
+	if err := cleanDevice(common.DeviceInfo{UDID: "android-1", OS: "android"}); err != nil {
+		t.Fatal(err)
+	}
+	apps, _ := fake.ListApps("android-1")
+	if fmt.Sprint(apps) != "[{ com.lab.vpn } { io.appium.uiautomator2.server.test }]" {
+		t.Errorf("apps left after cleanup %v", apps)
+	}
+	for _, want := range []string{
+		"kill android-1 com.android.chrome",
+		"clear android-1 com.android.chrome",
+		"uninstall android-1 com.team.app",
+		"rm android-1 /sdcard/Download",
+		"locale android-1 en_US",
+		"home android-1",
+	} {
+		if countCalls(fake.Calls(), want) != 1 {
+			t.Errorf("cleanup did not run %q, calls %v", want, fake.Calls())
+		}
+	}
+}
+
+func TestReleaseDeviceCleansOnlyAfterASession(t *testing.T) {
+	fake := provider.NewFake("android")
+	provider.Register(fake)
+	fake.Attach(common.DeviceInfo{UDID: "android-8"})
+	cleanupPolicy = CleanupPolicy{Default: "home", Profiles: map[string]CleanupProfile{"home": {PressHome: true}}}
+	t.Cleanup(func() {
+		cleanupPolicy = CleanupPolicy{}
+		registry.Default.Remove("android-8")
+	})
+	if err := registry.Default.Add(common.DeviceInfo{UDID: "android-8", OS: "android", State: common.StateInSession}); err != nil {
+		t.Fatal(err)
+	}
+
+	releaseDevice("android-8", &Session{TestID: "not-created", UDID: "android-8"})
+	if device, _ := registry.Get("android-8"); device.State != common.StateReady {
+		t.Errorf("device %s after a session that was not created, want ready", device.State)
+	}
+	if countCalls(fake.Calls(), "home android-8") != 0 {
+		t.Errorf("device cleaned without a session, calls %v", fake.Calls())
+	}
+
+	registry.Transition("android-8", common.StateInSession, "session for test created")
+	releaseDevice("android-8", &Session{ID: "session-8", TestID: "created", UDID: "android-8"})
+	if countCalls(fake.Calls(), "home android-8") != 1 {
+		t.Errorf("device not cleaned after its session, calls %v", fake.Calls())
+	}
+}
+
+func TestCleanupProfileSelection(t *testing.T) {
+	policy := CleanupPolicy{
+		Profiles:  map[string]CleanupProfile{"full": {PressHome: true}, "ios": {}, "none": {}},
+		Default:   "full",
+		Platforms: map[string]string{"ios": "ios"},
+		Devices:   map[string]string{"kiosk": "none"},
+	}
+	for udid, want := range map[string]string{"pixel": "full", "iphone": "ios", "kiosk": "none"} {
+		os := "android"
+		if udid == "iphone" {
+			os = "ios"
+		}
+		if _, name, _ := policy.profileFor(common.DeviceInfo{UDID: udid, OS: os}); name != want {
+			t.Errorf("%s cleaned with %q, want %q", udid, name, want)
+		}
+	}
+	if _, _, ok := (CleanupPolicy{}).profileFor(common.DeviceInfo{UDID: "pixel"}); ok {
+		t.Error("cleanup without a policy")
+	}
+}
+
+func countCalls(calls []string, call string) int {
+	count := 0
+	for _, c := range calls {
+		if c == call {
+			count++
+		}
+	}
+	return count
+}
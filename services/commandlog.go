@@ -0,0 +1,304 @@
+package services
+
+import (
+	"bufio"
+	"byod/common"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxLoggedRequest  = 65536 // bytes of a request body kept in the command log
+	maxLoggedResponse = 4096  // bytes of a response body kept in the command log
+	maxLoggedString   = 256   // characters of a single request string value kept in the command log
+)
+
+// sensitiveKeys are request fields whose values are never written to the command log.
+var sensitiveKeys = []string{"password", "passcode", "secret", "token"}
+
+// commandRecord is one line of a session command log.
+type commandRecord struct {
+	Time       time.Time       `json:"time"`
+	Method     string          `json:"method"`
+	Path       string          `json:"path"`
+	Request    interface{}     `json:"request,omitempty"`
+	Status     int             `json:"status"`
+	DurationMs int64           `json:"durationMs"`
+	Response   json.RawMessage `json:"response,omitempty"`
+	Screenshot string          `json:"screenshot,omitempty"`
+}
+
+// commandLog writes the WebDriver commands of one test as JSON lines to AppDirs.CommandLogs.
+type commandLog struct {
+	mu          sync.Mutex
+	testID      string
+	file        *os.File
+	writer      *bufio.Writer
+	screenshots int
+}
+
+// openCommandLog creates the command log of a test, replacing any previous one.
+func openCommandLog(testID string) (*commandLog, error) {
+	file, err := os.Create(filepath.Join(common.AppDirs.CommandLogs, testID+".jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	return &commandLog{testID: testID, file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+// record appends a command and its response to the log.
+func (l *commandLog) record(req *http.Request, body []byte, recorder *responseRecorder, started time.Time) {
+	record := commandRecord{
+		Time:       started,
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		Request:    sanitizeRequestBody(body),
+		Status:     recorder.status,
+		DurationMs: time.Since(started).Milliseconds(),
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return
+	}
+	if isScreenshotCommand(req) && recorder.status == http.StatusOK {
+		if name, err := l.saveScreenshot(recorder.body.Bytes()); err == nil {
+			record.Screenshot = name
+		} else {
+			log.Printf("commandLog :: unable to save screenshot for %s: %v\n", l.testID, err)
+		}
+	} else {
+		record.Response = truncatedResponse(recorder)
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	l.writer.Write(append(line, '\n'))
+	l.writer.Flush()
+}
+
+// saveScreenshot stores the base64 screenshot of a response in AppDirs.Screenshots and returns its file name.
+func (l *commandLog) saveScreenshot(response []byte) (string, error) {
+	var payload struct {
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(response, &payload); err != nil {
+		return "", err
+	}
+	image, err := base64.StdEncoding.DecodeString(payload.Value)
+	if err != nil {
+		return "", err
+	}
+	l.screenshots++
+	name := fmt.Sprintf("%s_%d.png", l.testID, l.screenshots)
+	return name, os.WriteFile(filepath.Join(common.AppDirs.Screenshots, name), image, 0644)
+}
+
+// close flushes and closes the log file.
+func (l *commandLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return
+	}
+	l.writer.Flush()
+	l.file.Close()
+	l.file = nil
+}
+
+// isScreenshotCommand reports whether the request is a session or element screenshot command.
+func isScreenshotCommand(req *http.Request) bool {
+	return req.Method == http.MethodGet && strings.HasSuffix(req.URL.Path, "/screenshot")
+}
+
+// truncatedResponse returns the recorded response as JSON, falling back to a truncated string.
+func truncatedResponse(recorder *responseRecorder) json.RawMessage {
+	body := recorder.body.Bytes()
+	if len(body) == 0 {
+		return nil
+	}
+	if !recorder.truncated && json.Valid(body) {
+		return json.RawMessage(body)
+	}
+	text := string(body)
+	if recorder.truncated {
+		text += "...(truncated)"
+	}
+	raw, _ := json.Marshal(text)
+	return raw
+}
+
+// sanitizeRequestBody decodes a JSON request body, masking secrets and shortening long values such as file payloads.
+func sanitizeRequestBody(body []byte) interface{} {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return shorten(string(body))
+	}
+	return sanitizeValue("", value)
+}
+
+func sanitizeValue(key string, value interface{}) interface{} {
+	if isSensitiveKey(key) {
+		return "***"
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = sanitizeValue(k, item)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = sanitizeValue(key, item)
+		}
+		return v
+	case string:
+		return shorten(v)
+	default:
+		return v
+	}
+}
+
+// isSensitiveKey reports whether a request field holds a secret.
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	if key == "pin" {
+		return true
+	}
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// shorten cuts strings longer than maxLoggedString, keeping their original length.
+func shorten(value string) string {
+	if len(value) <= maxLoggedString {
+		return value
+	}
+	return fmt.Sprintf("%s...(%d bytes)", value[:maxLoggedString], len(value))
+}
+
+// responseRecorder passes a response through while keeping its status and the beginning of its body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	limit     int // maximum bytes kept, 0 keeps everything
+	truncated bool
+}
+
+func newResponseRecorder(res http.ResponseWriter, keepAll bool) *responseRecorder {
+	recorder := &responseRecorder{ResponseWriter: res, status: http.StatusOK, limit: maxLoggedResponse}
+	if keepAll {
+		recorder.limit = 0
+	}
+	return recorder
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	keep := data
+	if r.limit > 0 {
+		if room := r.limit - r.body.Len(); room < len(keep) {
+			if room < 0 {
+				room = 0
+			}
+			keep = keep[:room]
+			r.truncated = true
+		}
+	}
+	r.body.Write(keep)
+	return r.ResponseWriter.Write(data)
+}
+
+// Flush lets streamed responses through the recorder.
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// requestCapture passes a request body through while keeping its beginning for the command log.
+type requestCapture struct {
+	io.ReadCloser
+	body bytes.Buffer
+}
+
+func (c *requestCapture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if room := maxLoggedRequest - c.body.Len(); room > 0 {
+		if n < room {
+			room = n
+		}
+		c.body.Write(p[:room])
+	}
+	return n, err
+}
+
+// serveLogged proxies a session command, records it in the session command log and watches the response for driver crashes.
+func serveLogged(res http.ResponseWriter, req *http.Request, session *Session, serve func(http.ResponseWriter, *http.Request)) {
+	if session == nil {
+		serve(res, req)
+		return
+	}
+	capture := &requestCapture{ReadCloser: http.NoBody}
+	if req.Body != nil {
+		capture.ReadCloser = req.Body
+		req.Body = capture
+	}
+	started := time.Now()
+	recorder := newResponseRecorder(res, session.commandLog != nil && isScreenshotCommand(req))
+	serve(recorder, req)
+	if detail, crashed := driverCrash(recorder); crashed {
+		session.driverCrashed(detail)
+	}
+	if session.commandLog != nil {
+		session.commandLog.record(req, capture.body.Bytes(), recorder, started)
+	}
+}
+
+// driverCrashMessages are the appium error messages telling that the WebDriverAgent or UiAutomator2 server died.
+var driverCrashMessages = []string{
+	"instrumentation process is not running",          // UiAutomator2 server crashed
+	"UiAutomator2 server because the instrumentation", // UiAutomator2 server could not be restarted
+	"cannot be proxied to UiAutomator2 server",        // UiAutomator2 server unreachable
+	"Could not proxy command to the remote server",    // WebDriverAgent unreachable
+	"socket hang up",
+}
+
+// driverCrash reports whether a command failed because the driver server on the device is gone.
+func driverCrash(recorder *responseRecorder) (string, bool) {
+	if recorder.status < http.StatusInternalServerError {
+		return "", false
+	}
+	body := recorder.body.String()
+	for _, message := range driverCrashMessages {
+		if strings.Contains(body, message) {
+			return message, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,186 @@
+package services
+
+import (
+	"byod/common"
+	"byod/registry"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DeviceRecord describes a device in the device inventory API.
+type DeviceRecord struct {
+	common.DeviceInfo
+	AppiumPort  string          `json:"appium_port,omitempty"`
+	Session     *SessionSummary `json:"session,omitempty"`
+	QueueLength int             `json:"queue_length"`
+	Recovery    *RecoveryStatus `json:"recovery,omitempty"` // last reboot or recovery
+}
+
+// DevicesResponse represents the JSON structure of device inventory responses.
+type DevicesResponse struct {
+	Status  string         `json:"status"`
+	Devices []DeviceRecord `json:"devices,omitempty"`
+	Device  *DeviceRecord  `json:"device,omitempty"`
+}
+
+// DeviceOptionsResponse represents the JSON structure of device options responses.
+type DeviceOptionsResponse struct {
+	Status  string               `json:"status"`
+	Options common.DeviceOptions `json:"options"`
+}
+
+// DevicesHandler lists the devices of the host or describes one device.
+// The list is filtered by the os, state, status, brand, model, transport and busy query parameters.
+// Requests below /devices/{udid}/options are handed to DeviceOptionsHandler, reboots and recoveries to RecoveryHandler.
+func DevicesHandler(w http.ResponseWriter, r *http.Request) {
+	udid := strings.Trim(strings.TrimPrefix(r.URL.Path, "/devices"), "/")
+	w.Header().Set("Content-Type", "application/json")
+	if parts := strings.SplitN(udid, "/", 2); len(parts) > 1 {
+		switch parts[1] {
+		case "options":
+			DeviceOptionsHandler(w, r, parts[0])
+		case actionReboot, actionRecover:
+			RecoveryHandler(w, r, parts[0], parts[1])
+		default:
+			http.Error(w, `{"status":"not found"}`, http.StatusNotFound)
+		}
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"status":"method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	if udid == "" {
+		filters, err := deviceFilters(r.URL.Query())
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"status":%q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		devices := []DeviceRecord{}
+		for _, device := range registry.List(filters...) {
+			devices = append(devices, deviceRecord(device))
+		}
+		writeDevicesResponse(w, DevicesResponse{Status: "success", Devices: devices})
+		return
+	}
+
+	device, ok := lookupDevice(udid)
+	if !ok {
+		http.Error(w, `{"status":"device not found"}`, http.StatusNotFound)
+		return
+	}
+	record := deviceRecord(device)
+	writeDevicesResponse(w, DevicesResponse{Status: "success", Device: &record})
+}
+
+// DeviceOptionsHandler reads or updates the preparation options of a device, the PIN is never returned.
+// Options may be set before the device is attached, only by the host owner and admins of the host organization.
+func DeviceOptionsHandler(w http.ResponseWriter, r *http.Request, udid string) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if !canManageDevices(requestUser(r)) {
+			http.Error(w, `{"status":"forbidden"}`, http.StatusForbidden)
+			return
+		}
+		options := deviceOptions(udid) // fields missing from the body keep their value
+		if err := json.NewDecoder(r.Body).Decode(&options); err != nil {
+			http.Error(w, `{"status":"invalid options"}`, http.StatusBadRequest)
+			return
+		}
+		if err := saveDeviceOptions(udid, options); err != nil {
+			http.Error(w, fmt.Sprintf(`{"status":%q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		log.Printf("DeviceOptionsHandler :: options of %s updated by %s\n", udid, requestUser(r).Username)
+	default:
+		http.Error(w, `{"status":"method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	options := deviceOptions(udid)
+	if options.PIN != "" {
+		options.PIN = "****"
+	}
+	if err := json.NewEncoder(w).Encode(DeviceOptionsResponse{Status: "success", Options: options}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// deviceFilters translates the query parameters of a device listing into registry filters.
+func deviceFilters(query map[string][]string) ([]registry.Filter, error) {
+	var filters []registry.Filter
+	get := func(key string) string {
+		if values := query[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	if os := get("os"); os != "" {
+		filters = append(filters, registry.ByOS(strings.ToLower(os)))
+	}
+	if state := get("state"); state != "" {
+		var states []common.DeviceState
+		for _, name := range strings.Split(state, ",") {
+			s := common.DeviceState(strings.TrimSpace(name))
+			if !s.Valid() {
+				return nil, fmt.Errorf("unknown state %s", name)
+			}
+			states = append(states, s)
+		}
+		filters = append(filters, registry.ByState(states...))
+	}
+	if status := get("status"); status != "" {
+		filters = append(filters, func(device common.DeviceInfo) bool { return device.Status == status })
+	}
+	if brand := get("brand"); brand != "" {
+		filters = append(filters, func(device common.DeviceInfo) bool { return strings.EqualFold(device.Brand, brand) })
+	}
+	if model := get("model"); model != "" {
+		filters = append(filters, func(device common.DeviceInfo) bool {
+			return strings.EqualFold(device.Model, model) || strings.EqualFold(device.Name, model)
+		})
+	}
+	if transport := get("transport"); transport != "" {
+		filters = append(filters, func(device common.DeviceInfo) bool { return strings.EqualFold(device.Transport, transport) })
+	}
+	if busy := get("busy"); busy != "" {
+		wantBusy, err := strconv.ParseBool(busy)
+		if err != nil {
+			return nil, fmt.Errorf("busy must be true or false")
+		}
+		filters = append(filters, func(device common.DeviceInfo) bool {
+			_, locked := DeviceLocks.owner(device.UDID)
+			return locked == wantBusy
+		})
+	}
+	return filters, nil
+}
+
+// deviceRecord completes the registry snapshot of a device with its ports and current session.
+func deviceRecord(device common.DeviceInfo) DeviceRecord {
+	record := DeviceRecord{
+		DeviceInfo:  device,
+		AppiumPort:  appiumPort(device.UDID),
+		QueueLength: DeviceLocks.queueLength(device.UDID),
+	}
+	if session, ok := DeviceLocks.owner(device.UDID); ok {
+		if summary := summarizeSession(session); summary.SessionID != "" {
+			record.Session = &summary
+		}
+	}
+	if recovery, ok := lookupRecovery(device.UDID); ok {
+		record.Recovery = &recovery
+	}
+	return record
+}
+
+func writeDevicesResponse(w http.ResponseWriter, response DevicesResponse) {
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
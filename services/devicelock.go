@@ -0,0 +1,191 @@
+package services
+
+import (
+	"byod/common"
+	"byod/quarantine"
+	"byod/registry"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	maxQueueTimeout = 15 * time.Minute // caps how long a new-session request may wait for a busy device
+	endingWait      = 2 * time.Minute  // least wait for a device whose session ended and is being cleaned
+)
+
+// DeviceLocks grants exclusive use of each device to a single session.
+var DeviceLocks = newDeviceLocks()
+
+// deviceWaiter is a new-session request queued for a busy device.
+type deviceWaiter struct {
+	session *Session
+	granted chan struct{} // closed once the device has been handed over to the waiter
+}
+
+// deviceLocks tracks the owning session of every device and a FIFO queue of waiting sessions.
+type deviceLocks struct {
+	mu      sync.Mutex
+	owners  map[string]*Session
+	waiters map[string][]*deviceWaiter
+}
+
+func newDeviceLocks() *deviceLocks {
+	return &deviceLocks{
+		owners:  make(map[string]*Session),
+		waiters: make(map[string][]*deviceWaiter),
+	}
+}
+
+// acquire makes the session the owner of the device, waiting up to the given duration in FIFO order if it is busy.
+// A zero wait fails immediately when the device is owned by another session.
+func (l *deviceLocks) acquire(ctx context.Context, udid string, session *Session, wait time.Duration) error {
+	l.mu.Lock()
+	if _, busy := l.owners[udid]; !busy && len(l.waiters[udid]) == 0 {
+		l.owners[udid] = session
+		l.mu.Unlock()
+		return nil
+	}
+	if wait <= 0 {
+		l.mu.Unlock()
+		return fmt.Errorf("device %s is busy with another session", udid)
+	}
+	if wait > maxQueueTimeout {
+		wait = maxQueueTimeout
+	}
+	waiter := &deviceWaiter{session: session, granted: make(chan struct{})}
+	l.waiters[udid] = append(l.waiters[udid], waiter)
+	position := len(l.waiters[udid])
+	l.mu.Unlock()
+
+	log.Printf("device %s busy, test %s queued at position %d\n", udid, session.TestID, position)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	var reason error
+	select {
+	case <-waiter.granted:
+		return nil
+	case <-timer.C:
+		reason = fmt.Errorf("device %s still busy after waiting %v", udid, wait)
+	case <-ctx.Done():
+		reason = fmt.Errorf("stopped waiting for device %s: %v", udid, ctx.Err())
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-waiter.granted:
+		// handed over while timing out, keep the device
+		return nil
+	default:
+	}
+	l.removeWaiter(udid, waiter)
+	return reason
+}
+
+// release frees the device if it is owned by the session and hands it to the next waiter.
+func (l *deviceLocks) release(udid string, session *Session) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.owners[udid] != session {
+		return
+	}
+	if queue := l.waiters[udid]; len(queue) > 0 {
+		next := queue[0]
+		l.removeWaiter(udid, next)
+		l.owners[udid] = next.session
+		close(next.granted)
+		return
+	}
+	delete(l.owners, udid)
+}
+
+// owner returns the session currently owning the device.
+func (l *deviceLocks) owner(udid string) (*Session, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	session, ok := l.owners[udid]
+	return session, ok
+}
+
+// ending reports whether the device is held by a session that ended and is cleaning the device.
+func (l *deviceLocks) ending(udid string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	session, ok := l.owners[udid]
+	return ok && session.ending.Load()
+}
+
+// queueLength returns the number of sessions waiting for the device.
+func (l *deviceLocks) queueLength(udid string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.waiters[udid])
+}
+
+// removeWaiter drops a waiter from the device queue, the caller must hold the lock.
+func (l *deviceLocks) removeWaiter(udid string, waiter *deviceWaiter) {
+	queue := l.waiters[udid]
+	for i, w := range queue {
+		if w == waiter {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) == 0 {
+		delete(l.waiters, udid)
+		return
+	}
+	l.waiters[udid] = queue
+}
+
+// acquireDevice locks the named device, refusing devices that are not attached or cannot run sessions.
+// A device still cleaned after its last session is waited for, even when the client would not wait for a busy device.
+func acquireDevice(ctx context.Context, udid string, session *Session, wait time.Duration) error {
+	device, ok := registry.Get(udid)
+	if !ok {
+		return fmt.Errorf("device %s is not attached to this host", udid)
+	}
+	if !device.State.Schedulable() {
+		return fmt.Errorf("device %s is %s", udid, device.State)
+	}
+	if wait < endingWait && DeviceLocks.ending(udid) {
+		wait = endingWait
+	}
+	return DeviceLocks.acquire(ctx, udid, session, wait)
+}
+
+// beginDeviceSession moves a locked device into a session, releasing the lock when the device is not ready.
+func beginDeviceSession(udid string, session *Session) error {
+	if err := registry.Transition(udid, common.StateInSession, "session for test "+session.TestID); err != nil {
+		DeviceLocks.release(udid, session)
+		return fmt.Errorf("device %s cannot start a session: %v", udid, err)
+	}
+	return nil
+}
+
+// releaseDevice cleans a device after its session with its cleanup profile and hands the lock to the next waiting session.
+// Devices failing their cleanup are marked unhealthy so that no test inherits the leftovers.
+// Devices whose health score fell below the quarantine threshold are quarantined instead of going back to ready.
+// The cleanup is skipped when appium never created the session, the test did not touch the device.
+func releaseDevice(udid string, session *Session) {
+	if device, ok := registry.Get(udid); ok && device.State == common.StateInSession {
+		if session.ID == "" {
+			registry.Transition(udid, common.StateCleaning, "session for test "+session.TestID+" not created")
+			log.Printf("releaseDevice :: no session created on %s, skipping cleanup\n", udid)
+			quarantine.Admit(udid, "session not created")
+		} else {
+			registry.Transition(udid, common.StateCleaning, "session for test "+session.TestID+" ended")
+			if err := cleanDevice(device); err != nil {
+				log.Printf("releaseDevice :: cleanup of %s failed: %v\n", udid, err)
+				registry.Transition(udid, common.StateUnhealthy, "cleanup failed: "+err.Error())
+			} else {
+				quarantine.Admit(udid, "cleaned")
+			}
+		}
+	}
+	DeviceLocks.release(udid, session)
+}
@@ -0,0 +1,34 @@
+package services
+
+import (
+	"byod/common"
+	"byod/registry"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNewSessionWaitsForCleanupOfEndedSession(t *testing.T) {
+	if err := registry.Default.Add(common.DeviceInfo{UDID: "android-7", OS: "android", State: common.StateCleaning}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { registry.Default.Remove("android-7") })
+	previous, next := &Session{TestID: "previous"}, &Session{TestID: "next"}
+	if err := DeviceLocks.acquire(context.Background(), "android-7", previous, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DeviceLocks.release("android-7", next) })
+
+	if err := acquireDevice(context.Background(), "android-7", next, 0); err == nil {
+		t.Fatal("device of a running session acquired without waiting")
+	}
+
+	previous.ending.Store(true)
+	time.AfterFunc(50*time.Millisecond, func() { DeviceLocks.release("android-7", previous) })
+	if err := acquireDevice(context.Background(), "android-7", next, 0); err != nil {
+		t.Fatalf("session after a deleted one refused: %v", err)
+	}
+	if owner, _ := DeviceLocks.owner("android-7"); owner != next {
+		t.Errorf("device owned by %v, want the next session", owner)
+	}
+}
@@ -0,0 +1,86 @@
+package services
+
+import (
+	"byod/common"
+	"byod/storage"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const deviceOptionsKey = "Device_Options" // KV store key holding the options of every device
+
+// defaultDeviceOptions apply to the devices without stored options.
+var defaultDeviceOptions = common.DeviceOptions{StayAwake: true}
+
+// deviceOptionsMu serializes the read-modify-write of the stored options.
+var deviceOptionsMu sync.Mutex
+
+// deviceOptions returns the stored options of the device, the defaults when none are stored.
+func deviceOptions(udid string) common.DeviceOptions {
+	deviceOptionsMu.Lock()
+	defer deviceOptionsMu.Unlock()
+	if options, ok := loadDeviceOptions()[udid]; ok {
+		return options
+	}
+	return defaultDeviceOptions
+}
+
+// saveDeviceOptions validates and stores the options of the device.
+func saveDeviceOptions(udid string, options common.DeviceOptions) error {
+	if !validPIN(options.PIN) {
+		return fmt.Errorf("pin must be 4 to 16 digits")
+	}
+	if storage.Store == nil {
+		return fmt.Errorf("KV store unavailable")
+	}
+	deviceOptionsMu.Lock()
+	defer deviceOptionsMu.Unlock()
+	all := loadDeviceOptions()
+	all[udid] = options
+	return storage.Store.Put(deviceOptionsKey, all)
+}
+
+// loadDeviceOptions reads the options of every device, the caller must hold deviceOptionsMu.
+func loadDeviceOptions() map[string]common.DeviceOptions {
+	all := make(map[string]common.DeviceOptions)
+	if storage.Store != nil {
+		storage.Store.Get(deviceOptionsKey, &all)
+	}
+	return all
+}
+
+// validPIN reports whether the PIN is empty or made of 4 to 16 digits, the only characters typed on the device.
+func validPIN(pin string) bool {
+	if pin == "" {
+		return true
+	}
+	if len(pin) < 4 || len(pin) > 16 {
+		return false
+	}
+	for _, c := range pin {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// prepareSession runs the pre-session routine of the device platform with the options of the device.
+func prepareSession(os, udid string) error {
+	options := deviceOptions(udid)
+	if options.SkipPrepare {
+		return nil
+	}
+	p, err := deviceProvider(os)
+	if err != nil {
+		return err
+	}
+	started := time.Now()
+	if err := p.PrepareSession(udid, options); err != nil {
+		return err
+	}
+	log.Printf("prepareSession :: %s prepared in %v\n", udid, time.Since(started).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"byod/common"
+	"byod/provider"
+	"byod/storage"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useTempStore replaces the KV store with an empty one for the duration of the test.
+func useTempStore(t *testing.T) {
+	t.Helper()
+	store, err := storage.Open(filepath.Join(t.TempDir(), "byod.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := storage.Store
+	storage.Store = store
+	t.Cleanup(func() {
+		storage.Store = previous
+		store.Close()
+	})
+}
+
+func TestValidPIN(t *testing.T) {
+	for pin, want := range map[string]bool{"": true, "1234": true, "0000111122223333": true, "123": false, "12a4": false, "1234; reboot": false} {
+		if got := validPIN(pin); got != want {
+			t.Errorf("validPIN(%q) = %v, want %v", pin, got, want)
+		}
+	}
+}
+
+func TestPrepareSessionUsesStoredOptions(t *testing.T) {
+	useTempStore(t)
+	fake := provider.NewFake("android")
+	provider.Register(fake)
+	fake.Attach(common.DeviceInfo{UDID: "android-2"})
+
+	fake.FailPrepareSession("android-2", errors.New("screen is locked"))
+	if err := prepareSession("android", "android-2"); err == nil || err.Error() != "screen is locked" {
+		t.Errorf("preparation error %v, want the locked screen", err)
+	}
+
+	if err := saveDeviceOptions("android-2", common.DeviceOptions{PIN: "12"}); err == nil {
+		t.Error("short PIN accepted")
+	}
+	if err := saveDeviceOptions("android-2", common.DeviceOptions{PIN: "1357", SkipPrepare: true}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { saveDeviceOptions("android-2", defaultDeviceOptions) })
+	if options := deviceOptions("android-2"); options.PIN != "1357" || !options.SkipPrepare {
+		t.Errorf("stored options not read back %+v", options)
+	}
+	if err := prepareSession("android", "android-2"); err != nil {
+		t.Errorf("preparation not skipped: %v", err)
+	}
+}
+
+func TestDeviceOptionsNeedHostOwnerOrAdmin(t *testing.T) {
+	useTempStore(t)
+	host := common.UserInfo
+	common.UserInfo = common.UserDetails{UserID: 1, Username: "lab", OrgID: 7}
+	t.Cleanup(func() { common.UserInfo = host })
+
+	put := func(user common.UserDetails) int {
+		r := userRequest(http.MethodPut, "/devices/android-5/options", user)
+		r.Body = io.NopCloser(strings.NewReader(`{"skipPrepare":true}`))
+		w := httptest.NewRecorder()
+		DeviceOptionsHandler(w, r, "android-5")
+		return w.Code
+	}
+	if code := put(common.UserDetails{UserID: 2, Username: "tester", OrgID: 7}); code != http.StatusForbidden {
+		t.Errorf("options set by a tester answered %d, want 403", code)
+	}
+	if deviceOptions("android-5").SkipPrepare {
+		t.Fatal("options changed without authorization")
+	}
+	if code := put(common.UserDetails{UserID: 3, Username: "admin", OrgID: 7, Role: "admin"}); code != http.StatusOK {
+		t.Errorf("options set by an org admin answered %d, want 200", code)
+	}
+}
@@ -0,0 +1,92 @@
+package services
+
+import (
+	"byod/provider"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// PairRequest is the body of a wireless debugging pairing.
+type PairRequest struct {
+	Address string `json:"address"` // host:port of the pairing dialog
+	Code    string `json:"code"`    // six digit pairing code of the pairing dialog
+	Connect string `json:"connect"` // host:port of the wireless debugging screen, kept connected once paired
+}
+
+// networkDeviceAdder keeps a network device connected, set by the device watcher.
+var networkDeviceAdder func(address string) error
+
+// SetNetworkDeviceAdder sets the function keeping a paired network device connected.
+func SetNetworkDeviceAdder(add func(address string) error) {
+	networkDeviceAdder = add
+}
+
+// PairDeviceHandler pairs the host with an Android 11+ device through wireless debugging.
+// Only the host owner and admins of the host organization may add devices.
+// The connect address is kept connected until the host restarts, permanent devices belong in -network-devices.
+func PairDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"status":"method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	if !canManageDevices(requestUser(r)) {
+		http.Error(w, `{"status":"forbidden"}`, http.StatusForbidden)
+		return
+	}
+	var request PairRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, `{"status":"invalid pairing request"}`, http.StatusBadRequest)
+		return
+	}
+	if err := checkPairRequest(request); err != nil {
+		http.Error(w, fmt.Sprintf(`{"status":%q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+	p, err := deviceProvider("android")
+	if err != nil {
+		http.Error(w, `{"status":"android unavailable"}`, http.StatusServiceUnavailable)
+		return
+	}
+	connector, ok := p.(provider.NetworkConnector)
+	if !ok {
+		http.Error(w, `{"status":"network devices unsupported"}`, http.StatusServiceUnavailable)
+		return
+	}
+	if err := connector.Pair(request.Address, request.Code); err != nil {
+		log.Printf("PairDeviceHandler :: unable to pair %s: %v\n", request.Address, err)
+		http.Error(w, fmt.Sprintf(`{"status":%q}`, "pairing failed: "+err.Error()), http.StatusBadGateway)
+		return
+	}
+	log.Printf("PairDeviceHandler :: %s paired by %s\n", request.Address, requestUser(r).Username)
+	if request.Connect != "" && networkDeviceAdder != nil {
+		if err := networkDeviceAdder(request.Connect); err != nil {
+			http.Error(w, fmt.Sprintf(`{"status":%q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+	w.Write([]byte(`{"status":"success"}`))
+}
+
+// checkPairRequest validates the addresses and the code, which end up on the adb command line.
+func checkPairRequest(request PairRequest) error {
+	if err := provider.CheckAddress(request.Address); err != nil {
+		return err
+	}
+	if request.Connect != "" {
+		if err := provider.CheckAddress(request.Connect); err != nil {
+			return err
+		}
+	}
+	if len(request.Code) != 6 {
+		return fmt.Errorf("pairing code must be 6 digits")
+	}
+	for _, c := range request.Code {
+		if c < '0' || c > '9' {
+			return fmt.Errorf("pairing code must be 6 digits")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package services
+
+import "testing"
+
+func TestCheckPairRequest(t *testing.T) {
+	for _, test := range []struct {
+		request PairRequest
+		valid   bool
+	}{
+		{PairRequest{Address: "192.168.1.20:37099", Code: "482913"}, true},
+		{PairRequest{Address: "kiosk-3.lab:37099", Code: "482913", Connect: "kiosk-3.lab:41235"}, true},
+		{PairRequest{Address: "[fe80::1]:37099", Code: "482913"}, true},
+		{PairRequest{Address: "192.168.1.20", Code: "482913"}, false},
+		{PairRequest{Address: "192.168.1.20:37099", Code: "4829"}, false},
+		{PairRequest{Address: "192.168.1.20:37099", Code: "48291a"}, false},
+		{PairRequest{Address: "192.168.1.20:37099", Code: "482913", Connect: "$(reboot):5555"}, false},
+	} {
+		if err := checkPairRequest(test.request); (err == nil) != test.valid {
+			t.Errorf("checkPairRequest(%+v) = %v, want valid %v", test.request, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package services
+
+import (
+	"byod/common"
+	"byod/registry"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const reaperInterval = 30 * time.Second
+
+// sessionIdleTimeout is the time after the last command at which a session is considered abandoned.
+var sessionIdleTimeout = 30 * time.Minute
+
+// SetSessionIdleTimeout overrides the idle timeout after which sessions are reaped.
+func SetSessionIdleTimeout(timeout time.Duration) {
+	if timeout > 0 {
+		sessionIdleTimeout = timeout
+	}
+}
+
+// SessionReaperCron periodically ends sessions that are idle or whose device is no longer connected.
+func SessionReaperCron(stopChan chan struct{}) {
+	log.Println("starting SessionReaperCron.....")
+	for {
+		select {
+		case <-stopChan:
+			log.Println("received termination signal: stopping SessionReaperCron")
+			return
+		case <-time.After(reaperInterval):
+			reapSessions()
+		}
+	}
+}
+
+// reapSessions ends every session that lost its device, lost its appium server or is past the idle timeout.
+func reapSessions() {
+	Sessions.Range(func(key, value interface{}) bool {
+		session := value.(*Session)
+		if device, ok := registry.Get(session.UDID); !ok || device.State == common.StateOffline {
+			reap(session, endReasonDeviceLost, "device disconnected", false)
+		} else if server, ok := AppiumServers.Load(session.UDID); ok && server.(*appiumServer).crashed() {
+			session.driverCrashed("appium server crashed")
+			reap(session, endReasonCrash, "appium server crashed", false)
+		} else if idle := time.Since(session.LastActivity()); idle > sessionIdleTimeout {
+			reap(session, endReasonTimeout, fmt.Sprintf("idle for %v", idle.Round(time.Second)), true)
+		}
+		return true
+	})
+}
+
+// reap ends the session in its own goroutine, so that a slow cleanup does not hold back the other sessions.
+// Sessions already ending are left to whoever is ending them.
+func reap(session *Session, reason endReason, detail string, quit bool) {
+	if !session.ending.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		if quit {
+			quitAppiumSession(session)
+		}
+		endSession(session, reason, detail)
+	}()
+}
+
+// quitAppiumSession asks appium to delete the session so that the driver can clean up the device.
+func quitAppiumSession(session *Session) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/wd/hub/session/%s", session.TargetURL, session.ID), nil)
+	if err != nil {
+		return
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("reaper :: failed to quit session %s: %v\n", session.ID, err)
+		return
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,214 @@
+package services
+
+import (
+	"byod/common"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	capVideo            = "lt:video" // records the device screen for the session when true
+	screenrecordLimit   = 180        // seconds, the longest chunk android screenrecord supports
+	recorderStopTimeout = 30 * time.Second
+)
+
+// videoRecorder captures the screen of a device into AppDirs.Videos/<testId>.mp4 for the duration of a session.
+type videoRecorder struct {
+	udid     string
+	platform string
+	testID   string
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// startVideoRecording starts recording the device screen in the background.
+func startVideoRecording(udid, platform, testID string) *videoRecorder {
+	recorder := &videoRecorder{
+		udid:     udid,
+		platform: platform,
+		testID:   testID,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go func() {
+		defer close(recorder.done)
+		var err error
+		if platform == "ios" {
+			err = recorder.recordIOS()
+		} else {
+			err = recorder.recordAndroid()
+		}
+		if err != nil {
+			log.Printf("recorder :: video for test %s failed: %v\n", testID, err)
+			return
+		}
+		log.Printf("recorder :: video for test %s saved to %s\n", testID, recorder.output())
+	}()
+	log.Printf("recorder :: recording %s for test %s\n", udid, testID)
+	return recorder
+}
+
+// finish stops the recording and waits until the video file has been written.
+func (r *videoRecorder) finish() {
+	close(r.stop)
+	<-r.done
+}
+
+// output returns the path of the final video file.
+func (r *videoRecorder) output() string {
+	return filepath.Join(common.AppDirs.Videos, r.testID+".mp4")
+}
+
+// recordAndroid records chained screenrecord chunks on the device, then pulls and joins them.
+func (r *videoRecorder) recordAndroid() error {
+	var remoteChunks []string
+	for chunk := 0; ; chunk++ {
+		remote := fmt.Sprintf("/sdcard/lt_%s_%d.mp4", r.testID, chunk)
+		cmd := exec.Command(common.Adb, "-s", r.udid, "shell", "screenrecord", "--time-limit", strconv.Itoa(screenrecordLimit), remote)
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		remoteChunks = append(remoteChunks, remote)
+		exited := make(chan error, 1)
+		go func() { exited <- cmd.Wait() }()
+
+		stopped := false
+		var err error
+		select {
+		case err = <-exited:
+		case <-r.stop:
+			// SIGINT lets screenrecord finalize the mp4 instead of leaving a truncated file
+			common.Execute(fmt.Sprintf("%s -s %s shell pkill -INT screenrecord", common.Adb, r.udid))
+			select {
+			case <-exited:
+			case <-time.After(recorderStopTimeout):
+				cmd.Process.Kill()
+			}
+			stopped = true
+		}
+		if stopped || err != nil {
+			break
+		}
+	}
+
+	partsDir := filepath.Join(common.AppDirs.Videos, r.testID+".parts")
+	os.RemoveAll(partsDir)
+	if err := os.MkdirAll(partsDir, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(partsDir)
+
+	var parts []string
+	for i, remote := range remoteChunks {
+		local := filepath.Join(partsDir, fmt.Sprintf("%d.mp4", i))
+		if _, err := common.Execute(fmt.Sprintf("%s -s %s pull %s %s", common.Adb, r.udid, remote, local)); err != nil {
+			log.Printf("recorder :: unable to pull %s from %s: %v\n", remote, r.udid, err)
+			continue
+		}
+		common.Execute(fmt.Sprintf("%s -s %s shell rm -f %s", common.Adb, r.udid, remote))
+		parts = append(parts, local)
+	}
+	return joinVideoParts(parts, r.output())
+}
+
+// recordIOS serves the device screen as MJPEG through go-ios and encodes it to mp4 with ffmpeg.
+func (r *videoRecorder) recordIOS() error {
+	port, err := freeLocalPort()
+	if err != nil {
+		return err
+	}
+	stream := exec.Command(common.GoIOS, "screenshot", "--stream", "--port="+port, "--udid", r.udid)
+	if err := stream.Start(); err != nil {
+		return err
+	}
+	defer func() {
+		stream.Process.Kill()
+		stream.Wait()
+	}()
+	if err := waitForPort(port, 10*time.Second); err != nil {
+		return fmt.Errorf("go-ios screen stream not available: %v", err)
+	}
+
+	encoder := exec.Command("ffmpeg", "-y", "-loglevel", "error", "-f", "mjpeg", "-i", "http://127.0.0.1:"+port,
+		"-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2", "-c:v", "libx264", "-preset", "veryfast", "-pix_fmt", "yuv420p", r.output())
+	stdin, err := encoder.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := encoder.Start(); err != nil {
+		return fmt.Errorf("unable to start ffmpeg: %v", err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- encoder.Wait() }()
+
+	select {
+	case err := <-exited:
+		return fmt.Errorf("ffmpeg exited early: %v", exitStatus(err))
+	case <-r.stop:
+	}
+	// "q" asks ffmpeg to finish writing the mp4 trailer
+	io.WriteString(stdin, "q")
+	stdin.Close()
+	select {
+	case err := <-exited:
+		return err
+	case <-time.After(recorderStopTimeout):
+		encoder.Process.Kill()
+		return fmt.Errorf("ffmpeg did not stop within %v", recorderStopTimeout)
+	}
+}
+
+// joinVideoParts writes the parts as a single mp4, concatenating them with ffmpeg when there is more than one.
+func joinVideoParts(parts []string, output string) error {
+	switch len(parts) {
+	case 0:
+		return fmt.Errorf("no video recorded")
+	case 1:
+		return os.Rename(parts[0], output)
+	}
+	list := output + ".txt"
+	var entries strings.Builder
+	for _, part := range parts {
+		fmt.Fprintf(&entries, "file '%s'\n", part)
+	}
+	if err := os.WriteFile(list, []byte(entries.String()), 0644); err != nil {
+		return err
+	}
+	defer os.Remove(list)
+	_, err := common.Execute(fmt.Sprintf("ffmpeg -y -loglevel error -f concat -safe 0 -i %s -c copy %s", list, output))
+	return err
+}
+
+// freeLocalPort asks the kernel for an unused local TCP port.
+func freeLocalPort() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer listener.Close()
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port), nil
+}
+
+// waitForPort waits until something accepts connections on the local port.
+func waitForPort(port string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", "127.0.0.1:"+port, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
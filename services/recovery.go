@@ -0,0 +1,254 @@
+package services
+
+import (
+	"byod/common"
+	"byod/provider"
+	"byod/registry"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	actionReboot  = "reboot"
+	actionRecover = "recover"
+
+	recoveryRunning   = "running"
+	recoverySucceeded = "succeeded"
+	recoveryFailed    = "failed"
+)
+
+var (
+	rebootTimeout       = 5 * time.Minute // time a rebooted device has to come back to ready
+	recoveryStepTimeout = 2 * time.Minute // time a device has to come back to ready after a recovery step
+	recoverySettle      = 3 * time.Second // wait after a recovery step before preparing the device again
+)
+
+// RecoveryStatus describes the last reboot or recovery of a device.
+type RecoveryStatus struct {
+	Action     string    `json:"action"`         // reboot or recover
+	Step       string    `json:"step,omitempty"` // recovery step running or last run
+	Status     string    `json:"status"`         // running, succeeded or failed
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+}
+
+// RecoveryResponse represents the JSON structure of reboot and recovery responses.
+type RecoveryResponse struct {
+	Status   string         `json:"status"`
+	Recovery RecoveryStatus `json:"recovery"`
+}
+
+// recoveries keeps the last reboot or recovery of every device.
+var recoveries = struct {
+	sync.Mutex
+	byDevice map[string]RecoveryStatus
+}{byDevice: make(map[string]RecoveryStatus)}
+
+// devicePreparer provisions a device again, set by the device watcher.
+var devicePreparer func(udid string) error
+
+// SetDevicePreparer sets the function provisioning a device again after a recovery step.
+func SetDevicePreparer(prepare func(udid string) error) {
+	devicePreparer = prepare
+}
+
+// RecoveryHandler reboots or recovers a device in the background, holding its lock so that no session starts meanwhile.
+// Only the host owner and admins of the host organization may do so.
+// The outcome is reported in the device record, or in the response with ?wait=true.
+func RecoveryHandler(w http.ResponseWriter, r *http.Request, udid, action string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"status":"method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	if !canManageDevices(requestUser(r)) {
+		http.Error(w, `{"status":"forbidden"}`, http.StatusForbidden)
+		return
+	}
+	device, ok := lookupDevice(udid)
+	if !ok {
+		http.Error(w, `{"status":"device not found"}`, http.StatusNotFound)
+		return
+	}
+	p, err := deviceProvider(device.OS)
+	if err != nil {
+		http.Error(w, `{"status":"unsupported device"}`, http.StatusBadRequest)
+		return
+	}
+	owner := &Session{TestID: action, UDID: udid, OS: device.OS, StartedAt: time.Now(), Owner: requestUser(r)}
+	if err := DeviceLocks.acquire(r.Context(), udid, owner, 0); err != nil {
+		http.Error(w, `{"status":"device busy"}`, http.StatusConflict)
+		return
+	}
+	log.Printf("RecoveryHandler :: %s of %s requested by %s\n", action, udid, owner.Owner.Username)
+
+	setRecovery(udid, RecoveryStatus{Action: action, Status: recoveryRunning, StartedAt: owner.StartedAt})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer DeviceLocks.release(udid, owner)
+		runRecovery(p, udid, action)
+	}()
+
+	status := http.StatusAccepted
+	if r.URL.Query().Get("wait") == "true" {
+		select {
+		case <-done:
+			status = http.StatusOK
+		case <-r.Context().Done():
+			return
+		}
+	}
+	recovery, _ := lookupRecovery(udid)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(RecoveryResponse{Status: "success", Recovery: recovery}); err != nil {
+		log.Println("RecoveryHandler :: ", err)
+	}
+}
+
+// canManageDevices allows the user running the host and admins of its organization.
+func canManageDevices(user common.UserDetails) bool {
+	if user.UserID != 0 && user.UserID == common.UserInfo.UserID {
+		return true
+	}
+	return isOrgAdmin(user) && user.OrgID == common.UserInfo.OrgID
+}
+
+// runRecovery reboots or recovers the device and records the outcome.
+func runRecovery(p provider.DeviceProvider, udid, action string) {
+	var err error
+	if action == actionReboot {
+		err = rebootDevice(p, udid)
+	} else {
+		err = recoverDevice(p, udid)
+	}
+	updateRecovery(udid, func(recovery *RecoveryStatus) {
+		recovery.Status = recoverySucceeded
+		if err != nil {
+			recovery.Status = recoveryFailed
+			recovery.Error = err.Error()
+		}
+		recovery.FinishedAt = time.Now()
+	})
+	if err != nil {
+		log.Printf("runRecovery :: %s of %s failed: %v\n", action, udid, err)
+		return
+	}
+	log.Printf("runRecovery :: %s of %s succeeded, device ready\n", action, udid)
+}
+
+// rebootDevice restarts the device and waits until the watcher has it back to ready.
+func rebootDevice(p provider.DeviceProvider, udid string) error {
+	changes, unsubscribe := registry.Default.Subscribe()
+	defer unsubscribe()
+	if err := p.Reboot(udid); err != nil {
+		return err
+	}
+	return waitForReady(changes, udid, true, rebootTimeout)
+}
+
+// recoverDevice runs the recovery steps of the device in order until it is back to ready.
+// Host-wide steps are skipped while another device of the platform is in a session.
+func recoverDevice(p provider.DeviceProvider, udid string) error {
+	steps := p.RecoverySteps(udid)
+	for _, step := range steps {
+		if step.HostWide {
+			if other, busy := otherDeviceInSession(p.Platform(), udid); busy {
+				log.Printf("recoverDevice :: skipping %s on %s, %s is in a session\n", step.Name, udid, other)
+				continue
+			}
+		}
+		updateRecovery(udid, func(recovery *RecoveryStatus) { recovery.Step = step.Name })
+		log.Printf("recoverDevice :: trying %s on %s\n", step.Name, udid)
+		if err := recoveryStep(step, udid); err != nil {
+			log.Printf("recoverDevice :: %s did not recover %s: %v\n", step.Name, udid, err)
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("device not ready after %d recovery steps", len(steps))
+}
+
+// otherDeviceInSession returns a device of the platform other than udid whose session lock is held.
+func otherDeviceInSession(platform, udid string) (string, bool) {
+	for _, device := range registry.List(registry.ByOS(platform)) {
+		if _, locked := DeviceLocks.owner(device.UDID); locked && device.UDID != udid {
+			return device.UDID, true
+		}
+	}
+	return "", false
+}
+
+// recoveryStep runs one step, prepares the device again and waits until it is ready.
+func recoveryStep(step provider.RecoveryStep, udid string) error {
+	changes, unsubscribe := registry.Default.Subscribe()
+	defer unsubscribe()
+	if err := step.Run(); err != nil {
+		return err
+	}
+	time.Sleep(recoverySettle)
+	if devicePreparer == nil {
+		return fmt.Errorf("no device watcher to prepare the device")
+	}
+	if err := devicePreparer(udid); err != nil {
+		// the device may be reattaching, the watcher prepares it on its own then
+		log.Printf("recoveryStep :: unable to prepare %s: %v\n", udid, err)
+	}
+	return waitForReady(changes, udid, false, recoveryStepTimeout)
+}
+
+// waitForReady waits until the device is ready. With mustLeave the device first has to leave ready, as during a reboot.
+func waitForReady(changes <-chan registry.Event, udid string, mustLeave bool, timeout time.Duration) error {
+	if device, ok := registry.Get(udid); ok && !mustLeave && device.State == common.StateReady {
+		return nil
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	left := !mustLeave
+	for {
+		select {
+		case event := <-changes:
+			if event.Device.UDID != udid {
+				continue
+			}
+			if event.Type == registry.Removed || event.Device.State != common.StateReady {
+				left = true
+				continue
+			}
+			if left {
+				return nil
+			}
+		case <-timer.C:
+			if device, ok := registry.Get(udid); ok {
+				return fmt.Errorf("device %s after %v: %s", device.State, timeout, device.StateReason)
+			}
+			return fmt.Errorf("device not back after %v", timeout)
+		}
+	}
+}
+
+func setRecovery(udid string, recovery RecoveryStatus) {
+	recoveries.Lock()
+	defer recoveries.Unlock()
+	recoveries.byDevice[udid] = recovery
+}
+
+func updateRecovery(udid string, change func(recovery *RecoveryStatus)) {
+	recoveries.Lock()
+	defer recoveries.Unlock()
+	recovery := recoveries.byDevice[udid]
+	change(&recovery)
+	recoveries.byDevice[udid] = recovery
+}
+
+// lookupRecovery returns the last reboot or recovery of the device.
+func lookupRecovery(udid string) (RecoveryStatus, bool) {
+	recoveries.Lock()
+	defer recoveries.Unlock()
+	recovery, ok := recoveries.byDevice[udid]
+	return recovery, ok
+}
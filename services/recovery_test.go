@@ -0,0 +1,108 @@
+package services
+
+import (
+	"byod/common"
+	"byod/provider"
+	"byod/registry"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRecoverDeviceStopsAtFirstWorkingStep(t *testing.T) {
+	fake := provider.NewFake("android")
+	provider.Register(fake)
+	fake.Attach(common.DeviceInfo{UDID: "android-3"})
+	if err := registry.Default.Add(common.DeviceInfo{UDID: "android-3", OS: "android", State: common.StateUnhealthy}); err != nil {
+		t.Fatal(err)
+	}
+	recoverySettle, recoveryStepTimeout = 0, 100*time.Millisecond
+	prepared := 0
+	devicePreparer = func(udid string) error {
+		// only the second step brings the device back
+		if prepared++; prepared < 2 {
+			return errors.New("adb unreachable")
+		}
+		registry.Transition(udid, common.StatePreparing, "recovery")
+		return registry.Transition(udid, common.StateReady, "prepared")
+	}
+	t.Cleanup(func() {
+		registry.Default.Remove("android-3")
+		recoverySettle, recoveryStepTimeout, devicePreparer = 3*time.Second, 2*time.Minute, nil
+	})
+
+	setRecovery("android-3", RecoveryStatus{Action: actionRecover, Status: recoveryRunning})
+	runRecovery(fake, "android-3", actionRecover)
+
+	recovery, _ := lookupRecovery("android-3")
+	if recovery.Status != recoverySucceeded || recovery.Step != "reinstall" {
+		t.Errorf("recovery %+v, want succeeded at reinstall", recovery)
+	}
+	if countCalls(fake.Calls(), "reconnect android-3") != 1 || countCalls(fake.Calls(), "reinstall android-3") != 1 {
+		t.Errorf("recovery steps not run in order, calls %v", fake.Calls())
+	}
+	if device, _ := registry.Get("android-3"); device.State != common.StateReady {
+		t.Errorf("recovered device %s", device.State)
+	}
+}
+
+func TestHostWideRecoveryStepWaitsForOtherSessions(t *testing.T) {
+	fake := provider.NewFake("android")
+	provider.Register(fake)
+	for _, udid := range []string{"android-5", "android-6"} {
+		fake.Attach(common.DeviceInfo{UDID: udid})
+		if err := registry.Default.Add(common.DeviceInfo{UDID: udid, OS: "android", State: common.StateUnhealthy}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recoverySettle, recoveryStepTimeout = 0, 50*time.Millisecond
+	devicePreparer = func(udid string) error { return errors.New("adb unreachable") }
+	session := &Session{TestID: "other-test"}
+	t.Cleanup(func() {
+		DeviceLocks.release("android-6", session)
+		registry.Default.Remove("android-5")
+		registry.Default.Remove("android-6")
+		recoverySettle, recoveryStepTimeout, devicePreparer = 3*time.Second, 2*time.Minute, nil
+	})
+
+	if err := DeviceLocks.acquire(context.Background(), "android-6", session, 0); err != nil {
+		t.Fatal(err)
+	}
+	recoverDevice(fake, "android-5")
+	if countCalls(fake.Calls(), "restart-server android-5") != 0 {
+		t.Errorf("server restarted while android-6 is in a session, calls %v", fake.Calls())
+	}
+
+	DeviceLocks.release("android-6", session)
+	recoverDevice(fake, "android-5")
+	if countCalls(fake.Calls(), "restart-server android-5") != 1 {
+		t.Errorf("server not restarted once no other device is in a session, calls %v", fake.Calls())
+	}
+}
+
+func TestRecoveryNeedsHostOwnerOrAdmin(t *testing.T) {
+	host := common.UserInfo
+	common.UserInfo = common.UserDetails{UserID: 1, Username: "lab", OrgID: 7}
+	t.Cleanup(func() { common.UserInfo = host })
+	if err := registry.Default.Add(common.DeviceInfo{UDID: "android-4", OS: "android", State: common.StateReady}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { registry.Default.Remove("android-4") })
+
+	for _, user := range []common.UserDetails{
+		{UserID: 2, Username: "tester", OrgID: 7},
+		{UserID: 3, Username: "other-admin", OrgID: 8, Role: "admin"},
+	} {
+		w := httptest.NewRecorder()
+		RecoveryHandler(w, userRequest(http.MethodPost, "/devices/android-4/reboot", user), "android-4", actionReboot)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("reboot by %s answered %d, want 403", user.Username, w.Code)
+		}
+	}
+	if _, ok := lookupRecovery("android-4"); ok {
+		t.Error("device rebooted without authorization")
+	}
+}
@@ -0,0 +1,119 @@
+package services
+
+import (
+	"byod/common"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"regexp"
+)
+
+// maxNewSessionBody bounds the new-session payload, the only request body buffered by the router.
+const maxNewSessionBody = 10 << 20
+
+// regexSessionID matches /wd/hub/session/{id} and any command below it.
+var regexSessionID = regexp.MustCompile(`^/wd/hub/session/([^/]+)(/.*)?$`)
+
+// getSessionID extracts the session ID from a WebDriver command path.
+func getSessionID(path string) string {
+	if matches := regexSessionID.FindStringSubmatch(path); len(matches) > 1 {
+		return matches[1]
+	}
+	return ""
+}
+
+// isSessionDeletion reports whether the request ends the session rather than one of its windows or elements.
+func isSessionDeletion(req *http.Request, sessionID string) bool {
+	return req.Method == http.MethodDelete && req.URL.Path == "/wd/hub/session/"+sessionID
+}
+
+// SessionHandler routes W3C and JSONWP WebDriver requests below /wd/hub.
+// New-session payloads are buffered for capability processing; every other command
+// is streamed unchanged to the appium server owning the session.
+func SessionHandler(res http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/wd/hub/session" {
+		if req.Method != http.MethodPost {
+			writeWebDriverError(res, http.StatusMethodNotAllowed, "unknown method", fmt.Sprintf("%s is not supported on /wd/hub/session", req.Method))
+			return
+		}
+		routeNewSession(res, req)
+		return
+	}
+	if req.URL.Path == "/wd/hub/status" && req.Method == http.MethodGet {
+		writeHubStatus(res)
+		return
+	}
+
+	sessionID := getSessionID(req.URL.Path)
+	if sessionID == "" {
+		writeWebDriverError(res, http.StatusNotFound, "unknown command", fmt.Sprintf("%s %s is not a known command", req.Method, req.URL.Path))
+		return
+	}
+	session, ok := lookupSession(sessionID)
+	if !ok || !canAccessSession(requestUser(req), session) {
+		writeWebDriverError(res, http.StatusNotFound, "invalid session id", fmt.Sprintf("session %s does not exist or is not active", sessionID))
+		return
+	}
+	proxy := sessionProxy(session)
+	if proxy == nil {
+		writeWebDriverError(res, http.StatusInternalServerError, "unknown error", fmt.Sprintf("no appium server for session %s", sessionID))
+		return
+	}
+
+	if isSessionDeletion(req, sessionID) {
+		handleSessionDeletion(res, req, proxy, session)
+		return
+	}
+	session.touch()
+	if isWebSocketUpgrade(req) {
+		// BiDi under the base path, the connection is handed over and not part of the command log
+		proxy.ServeHTTP(res, req)
+		return
+	}
+	serveLogged(res, req, session, proxy.ServeHTTP)
+}
+
+// routeNewSession buffers the new-session payload and hands it to handleNewSession.
+func routeNewSession(res http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(res, req.Body, maxNewSessionBody))
+	if err != nil {
+		writeWebDriverError(res, http.StatusBadRequest, "invalid argument", fmt.Sprintf("unable to read new session payload: %v", err))
+		return
+	}
+	var testInfo common.TestInfo
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &testInfo); err != nil {
+			writeWebDriverError(res, http.StatusBadRequest, "invalid argument", fmt.Sprintf("new session payload is not valid JSON: %v", err))
+			return
+		}
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	handleNewSession(res, req, testInfo, body)
+}
+
+// sessionProxy returns the reverse proxy to the appium server of a session.
+func sessionProxy(session *Session) *httputil.ReverseProxy {
+	if proxy, ok := ReverseProxyMap.Load(session.ID); ok {
+		return proxy.(*httputil.ReverseProxy)
+	}
+	return getOrCreateProxy(session.TargetURL)
+}
+
+// canAccessSession allows the user who created a session and admins of the same organization.
+func canAccessSession(user common.UserDetails, session *Session) bool {
+	return canAccessTest(user, testOwner{UserID: session.Owner.UserID, Username: session.Owner.Username, OrgID: session.Owner.OrgID})
+}
+
+// writeHubStatus answers the WebDriver status command for the hub itself.
+func writeHubStatus(res http.ResponseWriter) {
+	res.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(res).Encode(map[string]interface{}{
+		"value": map[string]interface{}{
+			"ready":   true,
+			"message": "byod hub is ready to accept new sessions",
+		},
+	})
+}
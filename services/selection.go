@@ -0,0 +1,155 @@
+package services
+
+import (
+	"byod/common"
+	"byod/registry"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Capabilities used to pick a device when the client does not name a UDID.
+const (
+	capPlatformName       = "platformName"
+	capPlatformVersion    = "appium:platformVersion"
+	capMinPlatformVersion = "lt:minPlatformVersion"
+	capMaxPlatformVersion = "lt:maxPlatformVersion"
+	capBrand              = "lt:brand"
+	capModel              = "lt:model"
+)
+
+// lookupDevice returns the registry's view of a device.
+func lookupDevice(udid string) (common.DeviceInfo, bool) {
+	return registry.Get(udid)
+}
+
+// deviceSelector holds the device attributes requested through capabilities.
+type deviceSelector struct {
+	platform        string
+	platformVersion string
+	minVersion      string
+	maxVersion      string
+	brand           string
+	model           string
+}
+
+// newDeviceSelector reads the selection capabilities of a new-session request.
+func newDeviceSelector(request sessionRequest) deviceSelector {
+	return deviceSelector{
+		platform:        request.stringCapability(capPlatformName),
+		platformVersion: request.stringCapability(capPlatformVersion),
+		minVersion:      request.stringCapability(capMinPlatformVersion),
+		maxVersion:      request.stringCapability(capMaxPlatformVersion),
+		brand:           request.stringCapability(capBrand),
+		model:           request.stringCapability(capModel),
+	}
+}
+
+// String describes the selector for error messages.
+func (s deviceSelector) String() string {
+	var parts []string
+	for _, attr := range []struct{ name, value string }{
+		{"platform", s.platform},
+		{"version", s.platformVersion},
+		{"min version", s.minVersion},
+		{"max version", s.maxVersion},
+		{"brand", s.brand},
+		{"model", s.model},
+	} {
+		if attr.value != "" {
+			parts = append(parts, fmt.Sprintf("%s %q", attr.name, attr.value))
+		}
+	}
+	if len(parts) == 0 {
+		return "any device"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// matches reports whether the device satisfies every attribute of the selector.
+func (s deviceSelector) matches(device common.DeviceInfo) bool {
+	if s.platform != "" && !strings.EqualFold(s.platform, device.OS) {
+		return false
+	}
+	if s.platformVersion != "" && device.FullOSVersion != s.platformVersion && !strings.HasPrefix(device.FullOSVersion, s.platformVersion+".") {
+		return false
+	}
+	if s.minVersion != "" && compareVersions(device.FullOSVersion, s.minVersion) < 0 {
+		return false
+	}
+	if s.maxVersion != "" && compareVersions(device.FullOSVersion, s.maxVersion) > 0 {
+		return false
+	}
+	if s.brand != "" && !strings.EqualFold(s.brand, device.Brand) {
+		return false
+	}
+	if s.model != "" && !containsFold(device.Model, s.model) && !containsFold(device.Name, s.model) {
+		return false
+	}
+	return true
+}
+
+// containsFold reports whether substr is within s, ignoring case.
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// acquireMatchingDevice locks a free ready device matching the request, or waits for the least contended busy one.
+func acquireMatchingDevice(ctx context.Context, request sessionRequest, session *Session, wait time.Duration) (common.DeviceInfo, error) {
+	selector := newDeviceSelector(request)
+	candidates := registry.List(registry.Schedulable(), selector.matches)
+	if len(candidates) == 0 {
+		return common.DeviceInfo{}, fmt.Errorf("no available device matches %s", selector)
+	}
+	for _, device := range candidates {
+		if DeviceLocks.acquire(ctx, device.UDID, session, 0) == nil {
+			return device, nil
+		}
+	}
+	if wait <= 0 {
+		for _, device := range candidates {
+			// the device only waits for the cleanup of its last session
+			if DeviceLocks.ending(device.UDID) {
+				if err := DeviceLocks.acquire(ctx, device.UDID, session, endingWait); err != nil {
+					return common.DeviceInfo{}, err
+				}
+				return device, nil
+			}
+		}
+		return common.DeviceInfo{}, fmt.Errorf("all %d devices matching %s are busy", len(candidates), selector)
+	}
+
+	device := candidates[0]
+	for _, candidate := range candidates[1:] {
+		if DeviceLocks.queueLength(candidate.UDID) < DeviceLocks.queueLength(device.UDID) {
+			device = candidate
+		}
+	}
+	if err := DeviceLocks.acquire(ctx, device.UDID, session, wait); err != nil {
+		return common.DeviceInfo{}, err
+	}
+	return device, nil
+}
+
+// compareVersions compares two dotted version strings numerically, missing components count as zero.
+func compareVersions(a, b string) int {
+	partsA, partsB := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		var numA, numB int
+		if i < len(partsA) {
+			numA, _ = strconv.Atoi(partsA[i])
+		}
+		if i < len(partsB) {
+			numB, _ = strconv.Atoi(partsB[i])
+		}
+		if numA != numB {
+			if numA < numB {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,28 @@
+package services
+
+import (
+	"byod/common"
+	"testing"
+)
+
+func TestSelectorMatchesModel(t *testing.T) {
+	iphone := common.DeviceInfo{OS: "ios", Name: "Lab kiosk 3", Model: "iPhone15,2", FullOSVersion: "17.4"}
+	pixel := common.DeviceInfo{OS: "android", Name: "Pixel 7", Model: "Pixel 7", FullOSVersion: "14"}
+	tests := []struct {
+		selector deviceSelector
+		device   common.DeviceInfo
+		want     bool
+	}{
+		{deviceSelector{model: "iphone15"}, iphone, true},
+		{deviceSelector{model: "kiosk"}, iphone, true},
+		{deviceSelector{model: "iPhone14"}, iphone, false},
+		{deviceSelector{model: "pixel 7", platform: "android"}, pixel, true},
+		{deviceSelector{model: "pixel", platform: "ios"}, pixel, false},
+		{deviceSelector{platformVersion: "17", minVersion: "17.2"}, iphone, true},
+	}
+	for _, test := range tests {
+		if got := test.selector.matches(test.device); got != test.want {
+			t.Errorf("%s matches %+v = %v, want %v", test.selector, test.device, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package services
+
+import (
+	"byod/common"
+	"byod/quarantine"
+	"byod/registry"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+const selfTestInterval = time.Minute // interval between two scans for quarantined devices
+
+const (
+	SelfTestProbe   = "probe"   // the device answers health and app list queries
+	SelfTestSession = "session" // the probe, then an appium session is created and quit on the device
+)
+
+// selfTest is the check a quarantined device must pass after the cooldown to be readmitted.
+var selfTest = struct {
+	mode     string
+	cooldown time.Duration
+}{mode: SelfTestProbe, cooldown: 10 * time.Minute}
+
+// SetSelfTest sets the self-test of quarantined devices and the time they stay quarantined before it runs.
+func SetSelfTest(mode string, cooldown time.Duration) error {
+	if mode != SelfTestProbe && mode != SelfTestSession {
+		return fmt.Errorf("unknown self-test %q, use %s or %s", mode, SelfTestProbe, SelfTestSession)
+	}
+	selfTest.mode = mode
+	if cooldown > 0 {
+		selfTest.cooldown = cooldown
+	}
+	return nil
+}
+
+// SelfTestCron runs the self-test of the devices quarantined for longer than the cooldown.
+func SelfTestCron(stopChan chan struct{}) {
+	log.Println("starting SelfTestCron.....")
+	for {
+		select {
+		case <-stopChan:
+			log.Println("received termination signal: stopping SelfTestCron")
+			return
+		case <-time.After(selfTestInterval):
+			for _, device := range registry.List(registry.ByState(common.StateQuarantined)) {
+				if time.Since(device.StateSince) >= selfTest.cooldown {
+					testQuarantinedDevice(device)
+				}
+			}
+		}
+	}
+}
+
+// testQuarantinedDevice readmits the device when its self-test passes and quarantines it again otherwise.
+func testQuarantinedDevice(device common.DeviceInfo) {
+	if err := registry.Transition(device.UDID, common.StatePreparing, "self-test"); err != nil {
+		log.Println("selfTest :: ", err)
+		return
+	}
+	if err := runSelfTest(device); err != nil {
+		log.Printf("selfTest :: %s failed: %v\n", device.UDID, err)
+		registry.Transition(device.UDID, common.StateQuarantined, "self-test failed: "+err.Error())
+		return
+	}
+	log.Printf("selfTest :: %s passed, readmitting\n", device.UDID)
+	if err := quarantine.Readmit(device.UDID); err != nil {
+		log.Println("selfTest :: ", err)
+	}
+}
+
+// runSelfTest checks that the device answers its provider and, in session mode, that appium can drive it.
+func runSelfTest(device common.DeviceInfo) error {
+	p, err := deviceProvider(device.OS)
+	if err != nil {
+		return err
+	}
+	if _, err := p.Health(device.UDID); err != nil {
+		return fmt.Errorf("health unavailable: %v", err)
+	}
+	if _, err := p.ListApps(device.UDID); err != nil {
+		return fmt.Errorf("apps unavailable: %v", err)
+	}
+	if selfTest.mode != SelfTestSession {
+		return nil
+	}
+
+	port, err := freeAppiumPort(device.UDID)
+	if err != nil {
+		return err
+	}
+	logPath := fmt.Sprintf("%s/selftest_%s.log", common.AppDirs.AppiumLogs, device.UDID)
+	os.Remove(logPath)
+	server := newAppiumServer(device.UDID, port, logPath)
+	defer server.stop()
+	if err := server.start(); err != nil {
+		return err
+	}
+	return primeAppium(server, device.OS)
+}
@@ -135,10 +135,18 @@ func KillServer(ctx context.Context) {
 
 // setupRoutes configures the URL endpoints and their corresponding handlers.
 func setupRoutes(mux *http.ServeMux) {
-	mux.HandleFunc("/app", ApplicationHandler)     // Handle application-specific actions
-	mux.HandleFunc("/validate", ValidationHandler) // Handle validation actions
-	mux.HandleFunc("/wd/hub/", SessionHandler)     // Handle WebDriver sessions
-	mux.HandleFunc("/", GlobalHandler)             // Handle all other requests
+	mux.HandleFunc("/app", ApplicationHandler)         // Handle application-specific actions
+	mux.HandleFunc("/validate", ValidationHandler)     // Handle validation actions
+	mux.HandleFunc("/wd/hub/", SessionHandler)         // Handle WebDriver sessions
+	mux.HandleFunc("/bidi/", StreamHandler)            // Proxy WebDriver BiDi connections
+	mux.HandleFunc("/ws/", StreamHandler)              // Proxy appium WebSocket log broadcasts
+	mux.HandleFunc("/mjpeg/", StreamHandler)           // Proxy MJPEG screen streams
+	mux.HandleFunc("/sessions", SessionsHandler)       // List live sessions
+	mux.HandleFunc("/sessions/", SessionsHandler)      // Inspect or kill a live session, fetch test artifacts
+	mux.HandleFunc("/devices", DevicesHandler)         // List the devices of the host
+	mux.HandleFunc("/devices/", DevicesHandler)        // Describe one device, set its preparation options, reboot or recover it
+	mux.HandleFunc("/devices/pair", PairDeviceHandler) // Pair an Android device through wireless debugging
+	mux.HandleFunc("/", GlobalHandler)                 // Handle all other requests
 }
 
 // middleware applies various HTTP headers and controls the request flow.
@@ -2,8 +2,10 @@ package services
 
 import (
 	"byod/common"
-	"byod/storage"
+	"byod/ports"
+	"byod/quarantine"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,26 +13,115 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"os"
-	"os/exec"
-	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	AppiumServers   sync.Map
 	ReverseProxyMap sync.Map
-	regexSessionID  = regexp.MustCompile(`^/wd/hub/session(?:/([^/]+))?$`)
+	Sessions        sync.Map // session ID -> *Session
 )
 
-// getSessionID extracts the session ID from the URL path using a regular expression.
-func getSessionID(path string) string {
-	if matches := regexSessionID.FindStringSubmatch(path); len(matches) > 1 {
-		return matches[1]
+// newSessionResponse is the part of an appium new-session response tracked by the binary.
+type newSessionResponse struct {
+	Value struct {
+		SessionID    string          `json:"sessionId"`
+		Capabilities json.RawMessage `json:"capabilities"`
+	} `json:"value"`
+}
+
+// sessionContextKey carries the pending *Session of a new-session request to the proxy response hook.
+type sessionContextKey struct{}
+
+// Session tracks a live appium session proxied by the binary.
+type Session struct {
+	ID        string
+	TestID    string
+	UDID      string
+	OS        string
+	Port      string
+	TargetURL string
+	MjpegPort string
+	StartedAt time.Time
+	Owner     common.UserDetails
+
+	mu           sync.Mutex // guards the fields set while the session is created, the inventory APIs read them meanwhile
+	recordVideo  bool
+	record       *testRecord
+	commandLog   *commandLog
+	recorder     *videoRecorder
+	lastActivity atomic.Int64 // unix nanoseconds of the last proxied command
+	crashed      atomic.Bool  // a driver crash was counted against the device
+	ending       atomic.Bool  // the session was deleted, its device is held until cleaned
+}
+
+// set applies a change to the fields filled in while the session is created.
+func (s *Session) set(change func(s *Session)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	change(s)
+}
+
+// touch records the current time as the last activity of the session.
+func (s *Session) touch() {
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+// driverCrashed counts a crash of the session driver against the device, once per session.
+func (s *Session) driverCrashed(detail string) {
+	if s.crashed.CompareAndSwap(false, true) {
+		log.Printf("session %s on %s lost its driver: %s\n", s.ID, s.UDID, detail)
+		quarantine.Record(s.UDID, quarantine.DriverCrashed)
+	}
+}
+
+// LastActivity returns the time of the last command proxied for the session.
+func (s *Session) LastActivity() time.Time {
+	return time.Unix(0, s.lastActivity.Load())
+}
+
+// lookupSession returns the live session with the given ID.
+func lookupSession(sessionID string) (*Session, bool) {
+	if session, ok := Sessions.Load(sessionID); ok {
+		return session.(*Session), true
+	}
+	return nil, false
+}
+
+// registerSession marks a session as live once appium has returned its ID.
+func registerSession(session *Session, capabilities json.RawMessage) {
+	session.touch()
+	session.record.sessionCreated(session, capabilities)
+	if session.recordVideo {
+		session.recorder = startVideoRecording(session.UDID, session.OS, session.TestID)
+	}
+	Sessions.Store(session.ID, session)
+	quarantine.Record(session.UDID, quarantine.SessionStarted)
+	log.Printf("session %s started for test %s on %s\n", session.ID, session.TestID, session.UDID)
+}
+
+// endSession forgets a session, drops its proxy entries and stops its appium server.
+func endSession(session *Session, reason endReason, detail string) {
+	if _, loaded := Sessions.LoadAndDelete(session.ID); !loaded {
+		return
 	}
-	return ""
+	session.ending.Store(true)
+	log.Printf("session %s for test %s on %s ended: %s %s\n", session.ID, session.TestID, session.UDID, reason, detail)
+	ReverseProxyMap.Delete(session.ID)
+	ReverseProxyMap.Delete(session.TargetURL)
+	stopAppium(session.UDID)
+	if session.commandLog != nil {
+		session.commandLog.close()
+	}
+	if session.recorder != nil {
+		session.recorder.finish()
+	}
+	session.record.ended(reason, detail)
+	releaseDevice(session.UDID, session)
 }
 
 // getOrCreateProxy retrieves an existing reverse proxy for the target URL or creates a new one.
@@ -47,29 +138,36 @@ func getOrCreateProxy(targetURL string) *httputil.ReverseProxy {
 
 	proxy := httputil.NewSingleHostReverseProxy(parsedURL)
 	proxy.Director = func(req *http.Request) {
+		req.Header.Set("X-Forwarded-Host", req.Host)
 		req.URL.Scheme = parsedURL.Scheme
 		req.URL.Host = parsedURL.Host
 		req.Host = parsedURL.Host
-		req.Header.Set("X-Forwarded-Host", req.Header.Get("Host"))
 	}
 
 	proxy.ModifyResponse = func(resp *http.Response) error {
-		if strings.Contains(resp.Header.Get("Content-Type"), "application/json") {
+		// only new-session responses are inspected, every other response is streamed untouched
+		session, isNewSession := resp.Request.Context().Value(sessionContextKey{}).(*Session)
+		if isNewSession && strings.Contains(resp.Header.Get("Content-Type"), "application/json") {
 			originalBody, err := io.ReadAll(resp.Body)
 			if err != nil {
 				return err
 			}
 			defer resp.Body.Close()
-			var testInfo common.TestInfo
-			if err := json.Unmarshal(originalBody, &testInfo); err != nil {
+			var created newSessionResponse
+			if err := json.Unmarshal(originalBody, &created); err != nil {
 				return err
 			}
 
-			if testInfo.Value.SessionID != "" {
-				ReverseProxyMap.Store(testInfo.Value.SessionID, proxy)
+			if created.Value.SessionID != "" {
+				ReverseProxyMap.Store(created.Value.SessionID, proxy)
+				session.set(func(s *Session) { s.ID = created.Value.SessionID })
+				registerSession(session, created.Value.Capabilities)
+				originalBody = rewriteSessionURLs(originalBody, resp.Request, session)
 			}
 
 			resp.Body = io.NopCloser(bytes.NewReader(originalBody))
+			resp.ContentLength = int64(len(originalBody))
+			resp.Header.Set("Content-Length", strconv.Itoa(len(originalBody)))
 		}
 		return nil
 	}
@@ -78,82 +176,230 @@ func getOrCreateProxy(targetURL string) *httputil.ReverseProxy {
 	return proxy
 }
 
-// SessionHandler handles incoming session requests, either creating a new session or managing existing ones.
-func SessionHandler(res http.ResponseWriter, req *http.Request) {
-	var testInfo common.TestInfo
-	if err := json.NewDecoder(req.Body).Decode(&testInfo); err != nil {
-		http.Error(res, "Invalid request body", http.StatusBadRequest)
+// handleNewSession processes the creation of a new Appium session.
+func handleNewSession(res http.ResponseWriter, req *http.Request, testInfo common.TestInfo, body []byte) {
+	if testInfo.TestID == "" {
+		testInfo.TestID = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	// the test id names the record and artifact files
+	if !isSafeName(testInfo.TestID) {
+		writeWebDriverError(res, http.StatusBadRequest, "invalid argument", fmt.Sprintf("invalid testId %q", testInfo.TestID))
+		return
+	}
+	user := requestUser(req)
+	record, err := claimTestRecord(testInfo, user, body)
+	if err != nil {
+		writeWebDriverError(res, http.StatusBadRequest, "invalid argument", err.Error())
 		return
 	}
 
-	sessionID := getSessionID(req.URL.Path)
-	if sessionID == "" && req.URL.Path == "/wd/hub/session" && req.Method == "POST" {
-		handleNewSession(res, req, testInfo)
-	} else if proxy, ok := ReverseProxyMap.Load(sessionID); ok {
-		if req.Method == "DELETE" && strings.HasPrefix(req.URL.Path, "/wd/hub/session") {
-			handleSessionDeletion(res, req, proxy.(*httputil.ReverseProxy), testInfo.UDID)
-		} else {
-			proxy.(*httputil.ReverseProxy).ServeHTTP(res, req)
+	request, err := parseSessionRequest(body)
+	if err != nil {
+		record.failed(err)
+		writeWebDriverError(res, http.StatusBadRequest, "invalid argument", fmt.Sprintf("invalid capabilities: %v", err))
+		return
+	}
+	// manual sessions get a host generated payload once the device is known
+	if testInfo.TestType != "manual" {
+		sets, err := parseCapabilitySets(body)
+		if err == nil {
+			err = validateCapabilities(sets)
+		}
+		if err != nil {
+			record.failed(err)
+			writeCapabilityError(res, err)
+			return
 		}
+	}
+
+	if testInfo.UDID == "" {
+		testInfo.UDID = request.stringCapability(capUDID)
+	}
+	session := &Session{
+		TestID:    testInfo.TestID,
+		UDID:      testInfo.UDID,
+		StartedAt: time.Now(),
+		Owner:     user,
+		record:    record,
+	}
+	if testInfo.UDID != "" {
+		err = acquireDevice(req.Context(), testInfo.UDID, session, request.queueTimeout())
 	} else {
-		http.Error(res, `{"status": "invalid session"}`, http.StatusBadRequest)
+		err = allocateDevice(req, request, session, &testInfo)
 	}
-}
+	if err == nil {
+		err = beginDeviceSession(testInfo.UDID, session)
+	}
+	if err != nil {
+		log.Printf("handleNewSession :: %v\n", err)
+		record.failed(err)
+		writeWebDriverError(res, http.StatusInternalServerError, "session not created", err.Error())
+		return
+	}
+	record.deviceAllocated(testInfo.UDID)
 
-// handleNewSession processes the creation of a new Appium session.
-func handleNewSession(res http.ResponseWriter, req *http.Request, testInfo common.TestInfo) {
+	if testInfo.OS == "" {
+		testInfo.OS = request.stringCapability(capPlatformName)
+	}
+	testInfo.OS = devicePlatform(testInfo.UDID, testInfo.OS)
+	if testInfo.TestType == "manual" {
+		body, err = getSessionPayload(testInfo)
+	}
+	var hostPorts map[string]int
+	if err == nil {
+		hostPorts, err = sessionPorts(session, testInfo.OS)
+	}
+	if err == nil {
+		body, err = mergeHostCapabilities(body, testInfo.UDID, testInfo.OS, hostPorts)
+	}
+	if err != nil {
+		releaseDevice(testInfo.UDID, session)
+		record.failed(err)
+		writeCapabilityError(res, err)
+		return
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+
+	if err := prepareSession(testInfo.OS, testInfo.UDID); err != nil {
+		log.Printf("handleNewSession :: device %s not prepared: %v\n", testInfo.UDID, err)
+		releaseDevice(testInfo.UDID, session)
+		record.failed(err)
+		writeWebDriverError(res, http.StatusInternalServerError, "session not created", err.Error())
+		return
+	}
 	go launchApp(testInfo.OS, testInfo.UDID, testInfo.AppPackage)
-	os.Create(fmt.Sprintf("%s/%s.json", common.AppDirs.TestInfo, testInfo.TestID))
 
-	port := startAppium(testInfo.UDID, testInfo.TestID)
+	port, err := startAppium(testInfo.UDID, testInfo.TestID)
+	if err != nil {
+		log.Printf("handleNewSession :: appium failed to start for %s: %v\n", testInfo.UDID, err)
+		quarantine.Record(testInfo.UDID, quarantine.SessionFailed)
+		releaseDevice(testInfo.UDID, session)
+		record.failed(err)
+		writeWebDriverError(res, http.StatusInternalServerError, "session not created", err.Error())
+		return
+	}
+	record.appiumStarted(port)
 	targetURL := "http://localhost:" + port
 	proxy := getOrCreateProxy(targetURL)
+	session.set(func(s *Session) {
+		s.Port = port
+		s.TargetURL = targetURL
+		s.OS = testInfo.OS
+	})
+	session.recordVideo = request.boolCapability(capVideo) || testInfo.VideoLogs == "true"
 
-	if testInfo.TestType == "manual" {
-		req.Body, req.ContentLength = getSessionPayload(testInfo)
+	if session.commandLog, err = openCommandLog(testInfo.TestID); err != nil {
+		log.Printf("handleNewSession :: command log unavailable for %s: %v\n", testInfo.TestID, err)
+	}
+	serveLogged(res, req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, session)), session, proxy.ServeHTTP)
+
+	// appium did not hand out a session, so nothing will ever delete this server
+	if session.ID == "" {
+		log.Printf("handleNewSession :: no session created on %s, stopping appium\n", testInfo.UDID)
+		ReverseProxyMap.Delete(targetURL)
+		stopAppium(testInfo.UDID)
+		if session.commandLog != nil {
+			session.commandLog.close()
+		}
+		record.failed(fmt.Errorf("appium did not create a session, see %s/%s.log", common.AppDirs.AppiumLogs, testInfo.TestID))
+		quarantine.Record(testInfo.UDID, quarantine.SessionFailed)
+		releaseDevice(testInfo.UDID, session)
 	}
-	proxy.ServeHTTP(res, req)
 }
 
-// handleSessionDeletion handles the deletion of an Appium session.
-func handleSessionDeletion(res http.ResponseWriter, req *http.Request, proxy *httputil.ReverseProxy, udid string) {
-	req.Body = nil
-	req.ContentLength = 0
-	proxy.ServeHTTP(res, req)
-	go stopAppium(udid)
+// allocateDevice selects and locks a device for a request without a UDID.
+func allocateDevice(req *http.Request, request sessionRequest, session *Session, testInfo *common.TestInfo) error {
+	device, err := acquireMatchingDevice(req.Context(), request, session, request.queueTimeout())
+	if err != nil {
+		return err
+	}
+	log.Printf("handleNewSession :: selected device %s for test %s\n", device.UDID, testInfo.TestID)
+	testInfo.UDID = device.UDID
+	testInfo.OS = device.OS
+	session.set(func(s *Session) { s.UDID = device.UDID })
+	return nil
 }
 
-// startAppium starts the Appium server for the given UDID and test ID.
-func startAppium(udid, testId string) string {
-	var port string
-	appiumLogs := fmt.Sprintf("%s/%s.log", common.AppDirs.AppiumLogs, testId)
-	os.Remove(appiumLogs)
-	storage.Store.Get("Appium_Port_"+udid, &port)
-	cmd, err := common.ExecuteAsync(fmt.Sprintf("appium --base-path /wd/hub -p %s --log %s", port, appiumLogs))
+// mergeHostCapabilities applies the capability policy and host controlled capabilities to a new-session payload.
+func mergeHostCapabilities(body []byte, udid, platform string, hostPorts map[string]int) ([]byte, error) {
+	sets, err := parseCapabilitySets(body)
 	if err != nil {
-		log.Printf("Failed to execute command: %s\n", err)
-		return ""
+		return nil, err
 	}
-	AppiumServers.Store(udid, cmd)
-	time.Sleep(5 * time.Second)
-	return port
+	applyHostCapabilities(sets, udid, platform, hostPorts)
+	return sets.marshal()
 }
 
-// stopAppium stops the Appium server for the given UDID.
-func stopAppium(udid string) {
-	if cmd, _ := AppiumServers.Load(udid); cmd != nil {
-		cmd.(*exec.Cmd).Process.Kill()
-		AppiumServers.Delete(udid)
+// sessionPorts returns the port capabilities of the session from the lease of its device.
+func sessionPorts(session *Session, platform string) (map[string]int, error) {
+	lease, hostPorts, err := devicePorts(session.UDID, platform)
+	if err != nil {
+		return nil, err
+	}
+	session.set(func(s *Session) { s.MjpegPort = lease.Port(ports.MJPEG) })
+	return hostPorts, nil
+}
+
+// devicePorts returns the lease of the device, acquiring one when missing, and the port capabilities it forces.
+func devicePorts(udid, platform string) (ports.Lease, map[string]int, error) {
+	lease, ok := ports.Lookup(udid)
+	if !ok {
+		var err error
+		if lease, err = ports.Acquire(udid); err != nil {
+			return ports.Lease{}, nil, err
+		}
 	}
-	var port string
-	storage.Store.Get("Appium_Port_"+udid, &port)
-	if port != "" {
-		common.KillProcessOnPort(port)
+	hostPorts := map[string]int{capMjpegServerPort: lease.Ports[ports.MJPEG]}
+	if platform == "ios" {
+		hostPorts[capWdaLocalPort] = lease.Ports[ports.WDA]
+	} else {
+		hostPorts[capSystemPort] = lease.Ports[ports.System]
+		hostPorts[capChromedriverPort] = lease.Ports[ports.Chromedriver]
 	}
+	return lease, hostPorts, nil
+}
+
+// writeCapabilityError reports a capability problem to the client as a W3C error.
+func writeCapabilityError(res http.ResponseWriter, err error) {
+	if capErr, ok := err.(*capabilityError); ok {
+		writeWebDriverError(res, http.StatusBadRequest, capErr.code, capErr.message)
+		return
+	}
+	writeWebDriverError(res, http.StatusInternalServerError, "session not created", err.Error())
+}
+
+// handleSessionDeletion handles the deletion of an Appium session.
+func handleSessionDeletion(res http.ResponseWriter, req *http.Request, proxy *httputil.ReverseProxy, session *Session) {
+	req.Body = nil
+	req.ContentLength = 0
+	// marked before the client gets the reply, its next session waits for the cleanup instead of finding the device busy
+	session.ending.Store(true)
+	serveLogged(res, req, session, proxy.ServeHTTP)
+	go endSession(session, endReasonClientDelete, "")
+}
+
+// webDriverError is the W3C WebDriver error response body.
+type webDriverError struct {
+	Value struct {
+		Error      string `json:"error"`
+		Message    string `json:"message"`
+		Stacktrace string `json:"stacktrace"`
+	} `json:"value"`
+}
+
+// writeWebDriverError writes a W3C WebDriver error with the given HTTP status, error code and message.
+func writeWebDriverError(res http.ResponseWriter, status int, code, message string) {
+	var body webDriverError
+	body.Value.Error = code
+	body.Value.Message = message
+	res.Header().Set("Content-Type", "application/json; charset=utf-8")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(body)
 }
 
 // getSessionPayload generates the payload for starting a new Appium session.
-func getSessionPayload(testInfo common.TestInfo) (io.ReadCloser, int64) {
+func getSessionPayload(testInfo common.TestInfo) ([]byte, error) {
 	automationName := "UiAutomator2"
 	if testInfo.OS == "ios" {
 		automationName = "XCUITest"
@@ -185,11 +431,5 @@ func getSessionPayload(testInfo common.TestInfo) (io.ReadCloser, int64) {
 			AppiumConnectHardwareKeyboard: true,
 		},
 	}
-	jsonData, err := json.Marshal(payload)
-	if err != nil {
-		return nil, 0
-	}
-	reader := bytes.NewReader(jsonData)
-	readCloser := io.NopCloser(reader)
-	return readCloser, int64(len(jsonData))
+	return json.Marshal(payload)
 }
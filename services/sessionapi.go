@@ -0,0 +1,125 @@
+package services
+
+import (
+	"byod/common"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SessionSummary describes a live session in the session inventory API.
+type SessionSummary struct {
+	SessionID    string    `json:"sessionId"`
+	TestID       string    `json:"testId"`
+	UDID         string    `json:"udid"`
+	OS           string    `json:"os"`
+	Owner        string    `json:"owner"`
+	StartedAt    time.Time `json:"startedAt"`
+	LastActivity time.Time `json:"lastActivity"`
+	AppiumPort   string    `json:"appiumPort"`
+}
+
+// SessionsResponse represents the JSON structure of session inventory responses.
+type SessionsResponse struct {
+	Status   string           `json:"status"`
+	Sessions []SessionSummary `json:"sessions,omitempty"`
+	Session  *SessionSummary  `json:"session,omitempty"`
+}
+
+// SessionsHandler lists live sessions, describes one session or force-kills it.
+// Users only see and kill their own sessions, org admins those of their organization.
+// Requests below /sessions/{testId}/artifacts are handed to ArtifactsHandler.
+func SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/sessions"), "/")
+	if parts := strings.SplitN(sessionID, "/", 3); len(parts) > 1 {
+		// /sessions/{testId}/artifacts[/{name}]
+		if parts[1] != "artifacts" {
+			http.Error(w, `{"status":"not found"}`, http.StatusNotFound)
+			return
+		}
+		name := ""
+		if len(parts) == 3 {
+			name = parts[2]
+		}
+		ArtifactsHandler(w, r, parts[0], name)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	if sessionID == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, `{"status":"method not allowed"}`, http.StatusMethodNotAllowed)
+			return
+		}
+		writeSessionsResponse(w, SessionsResponse{Status: "success", Sessions: listSessions(requestUser(r))})
+		return
+	}
+
+	session, ok := lookupSession(sessionID)
+	if !ok {
+		http.Error(w, `{"status":"session not found"}`, http.StatusNotFound)
+		return
+	}
+	if !canAccessSession(requestUser(r), session) {
+		http.Error(w, `{"status":"forbidden"}`, http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		summary := summarizeSession(session)
+		writeSessionsResponse(w, SessionsResponse{Status: "success", Session: &summary})
+	case http.MethodDelete:
+		user := requestUser(r)
+		log.Printf("SessionsHandler :: session %s force killed by %s\n", session.ID, user.Username)
+		quitAppiumSession(session)
+		endSession(session, endReasonKilled, fmt.Sprintf("killed by %s", user.Username))
+		writeSessionsResponse(w, SessionsResponse{Status: "success"})
+	default:
+		http.Error(w, `{"status":"method not allowed"}`, http.StatusMethodNotAllowed)
+	}
+}
+
+// listSessions returns a summary of the live sessions the user can access ordered by start time.
+func listSessions(user common.UserDetails) []SessionSummary {
+	sessions := []SessionSummary{}
+	Sessions.Range(func(key, value interface{}) bool {
+		if session := value.(*Session); canAccessSession(user, session) {
+			sessions = append(sessions, summarizeSession(session))
+		}
+		return true
+	})
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].StartedAt.Before(sessions[j].StartedAt) })
+	return sessions
+}
+
+// summarizeSession converts a session into its API representation, the session may still be in creation.
+func summarizeSession(session *Session) SessionSummary {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return SessionSummary{
+		SessionID:    session.ID,
+		TestID:       session.TestID,
+		UDID:         session.UDID,
+		OS:           session.OS,
+		Owner:        session.Owner.Username,
+		StartedAt:    session.StartedAt,
+		LastActivity: session.LastActivity(),
+		AppiumPort:   session.Port,
+	}
+}
+
+func writeSessionsResponse(w http.ResponseWriter, response SessionsResponse) {
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// requestUser returns the authenticated user stored in the request context by the middleware.
+func requestUser(r *http.Request) common.UserDetails {
+	user, _ := r.Context().Value(common.UserContextKey).(common.UserDetails)
+	return user
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"byod/common"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// userRequest returns a request authenticated as the user.
+func userRequest(method, target string, user common.UserDetails) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	return r.WithContext(context.WithValue(r.Context(), common.UserContextKey, user))
+}
+
+func TestSessionsAreLimitedToTheirOwner(t *testing.T) {
+	alice := common.UserDetails{UserID: 1, Username: "alice", OrgID: 7}
+	bob := common.UserDetails{UserID: 2, Username: "bob", OrgID: 7}
+	admin := common.UserDetails{UserID: 3, Username: "carol", OrgID: 7, Role: "admin"}
+	Sessions.Store("s-alice", &Session{ID: "s-alice", TestID: "t-alice", StartedAt: time.Now(), Owner: alice})
+	Sessions.Store("s-bob", &Session{ID: "s-bob", TestID: "t-bob", StartedAt: time.Now(), Owner: bob})
+	t.Cleanup(func() {
+		Sessions.Delete("s-alice")
+		Sessions.Delete("s-bob")
+	})
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		w := httptest.NewRecorder()
+		SessionsHandler(w, userRequest(method, "/sessions/s-alice", bob))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s of another user's session answered %d, want 403", method, w.Code)
+		}
+	}
+	if _, ok := lookupSession("s-alice"); !ok {
+		t.Fatal("session killed by another user")
+	}
+
+	for user, want := range map[*common.UserDetails]int{&alice: 1, &admin: 2} {
+		w := httptest.NewRecorder()
+		SessionsHandler(w, userRequest(http.MethodGet, "/sessions", *user))
+		var response SessionsResponse
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Sessions) != want {
+			t.Errorf("%s sees %d sessions, want %d", user.Username, len(response.Sessions), want)
+		}
+	}
+}
+
+func TestDeviceRecordOfSessionInCreation(t *testing.T) {
+	session := &Session{TestID: "t-creating", UDID: "android-9", StartedAt: time.Now()}
+	if err := DeviceLocks.acquire(context.Background(), "android-9", session, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DeviceLocks.release("android-9", session) })
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		session.set(func(s *Session) {
+			s.Port = "4725"
+			s.OS = "android"
+		})
+		session.set(func(s *Session) { s.ID = "s-creating" })
+	}()
+	// the inventory reads the session while it is being created
+	deviceRecord(common.DeviceInfo{UDID: "android-9"})
+	<-done
+	if record := deviceRecord(common.DeviceInfo{UDID: "android-9"}); record.Session == nil || record.Session.AppiumPort != "4725" {
+		t.Errorf("created session missing from the device record %+v", record.Session)
+	}
+}
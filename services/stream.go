@@ -0,0 +1,117 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const capMjpegURL = "lt:mjpegUrl" // MJPEG screen stream of the session, reachable through the binary
+
+var (
+	// regexStreamSessionID matches the session ID of /bidi/{id}, /ws/session/{id}/... and /mjpeg/{id}.
+	regexStreamSessionID = regexp.MustCompile(`^/(?:bidi|ws/session|mjpeg)/([^/]+)`)
+	// regexLocalURL matches URLs pointing at a port on the host itself.
+	regexLocalURL = regexp.MustCompile(`^(wss?|https?)://(?:127\.0\.0\.1|localhost|0\.0\.0\.0|\[::1\]):\d+`)
+)
+
+// StreamHandler proxies the long-lived endpoints of a session: WebDriver BiDi (/bidi/{id}),
+// appium WebSocket broadcasts (/ws/session/{id}/...) and the MJPEG screen stream (/mjpeg/{id}).
+func StreamHandler(res http.ResponseWriter, req *http.Request) {
+	matches := regexStreamSessionID.FindStringSubmatch(req.URL.Path)
+	if len(matches) < 2 {
+		writeWebDriverError(res, http.StatusNotFound, "unknown command", fmt.Sprintf("%s is not a known stream", req.URL.Path))
+		return
+	}
+	session, ok := lookupSession(matches[1])
+	if !ok || !canAccessSession(requestUser(req), session) {
+		writeWebDriverError(res, http.StatusNotFound, "invalid session id", fmt.Sprintf("session %s does not exist or is not active", matches[1]))
+		return
+	}
+	session.touch()
+
+	if strings.HasPrefix(req.URL.Path, "/mjpeg/") {
+		mjpegProxy(session).ServeHTTP(res, req)
+		return
+	}
+	proxy := sessionProxy(session)
+	if proxy == nil {
+		writeWebDriverError(res, http.StatusInternalServerError, "unknown error", fmt.Sprintf("no appium server for session %s", session.ID))
+		return
+	}
+	proxy.ServeHTTP(res, req)
+}
+
+// mjpegProxy returns a streaming proxy to the MJPEG server the driver forwards to the session's mjpeg port.
+func mjpegProxy(session *Session) *httputil.ReverseProxy {
+	target := &url.URL{Scheme: "http", Host: "localhost:" + session.MjpegPort}
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.URL.Path = "/"
+			req.URL.RawPath = ""
+			req.Host = target.Host
+		},
+		FlushInterval: -1,
+		ErrorHandler: func(res http.ResponseWriter, req *http.Request, err error) {
+			log.Printf("mjpegProxy :: stream for session %s unavailable: %v\n", session.ID, err)
+			writeWebDriverError(res, http.StatusBadGateway, "unknown error", "mjpeg stream is not available for this session")
+		},
+	}
+}
+
+// isWebSocketUpgrade reports whether the request asks to switch to the WebSocket protocol.
+func isWebSocketUpgrade(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(req.Header.Get("Connection")), "upgrade")
+}
+
+// rewriteSessionURLs points the host-local URLs of a new-session response back through the binary
+// and advertises the MJPEG stream of the session.
+func rewriteSessionURLs(body []byte, outbound *http.Request, session *Session) []byte {
+	var response map[string]interface{}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return body
+	}
+	value, _ := response["value"].(map[string]interface{})
+	capabilities, _ := value["capabilities"].(map[string]interface{})
+	if capabilities == nil {
+		return body
+	}
+
+	host := outbound.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		return body
+	}
+	secure := isHttpsEnabled || strings.EqualFold(outbound.Header.Get("X-Forwarded-Proto"), "https")
+	for name, raw := range capabilities {
+		if link, ok := raw.(string); ok && regexLocalURL.MatchString(link) {
+			capabilities[name] = regexLocalURL.ReplaceAllStringFunc(link, func(local string) string {
+				scheme := regexLocalURL.FindStringSubmatch(local)[1]
+				if secure && (scheme == "ws" || scheme == "http") {
+					scheme += "s"
+				}
+				return scheme + "://" + host
+			})
+		}
+	}
+	if session.MjpegPort != "" {
+		scheme := "http"
+		if secure {
+			scheme = "https"
+		}
+		capabilities[capMjpegURL] = fmt.Sprintf("%s://%s/mjpeg/%s", scheme, host, session.ID)
+	}
+
+	rewritten, err := json.Marshal(response)
+	if err != nil {
+		return body
+	}
+	return rewritten
+}
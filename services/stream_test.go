@@ -0,0 +1,70 @@
+package services
+
+import (
+	"byod/common"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRewriteSessionURLs(t *testing.T) {
+	session := &Session{ID: "s-1", MjpegPort: "9100"}
+	body := []byte(`{"value":{"sessionId":"s-1","capabilities":{"webSocketUrl":"ws://127.0.0.1:4725/bidi/s-1","appium:udid":"android-1"}}}`)
+	outbound := httptest.NewRequest(http.MethodPost, "/wd/hub/session", nil)
+	outbound.Header.Set("X-Forwarded-Host", "byod.lab:4723")
+	outbound.Header.Set("X-Forwarded-Proto", "https")
+
+	var response struct {
+		Value struct {
+			Capabilities map[string]string `json:"capabilities"`
+		} `json:"value"`
+	}
+	if err := json.Unmarshal(rewriteSessionURLs(body, outbound, session), &response); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"webSocketUrl": "wss://byod.lab:4723/bidi/s-1",
+		"appium:udid":  "android-1",
+		capMjpegURL:    "https://byod.lab:4723/mjpeg/s-1",
+	} {
+		if got := response.Value.Capabilities[name]; got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	// without a forwarded host nothing tells where the client reached the binary
+	outbound.Header.Del("X-Forwarded-Host")
+	if got := rewriteSessionURLs(body, outbound, session); string(got) != string(body) {
+		t.Errorf("body rewritten without a forwarded host: %s", got)
+	}
+}
+
+func TestStreamOfAnotherUsersSessionNotFound(t *testing.T) {
+	appium := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"value":null}`))
+	}))
+	t.Cleanup(appium.Close)
+	alice := common.UserDetails{UserID: 1, Username: "alice", OrgID: 7}
+	bob := common.UserDetails{UserID: 2, Username: "bob", OrgID: 7}
+	Sessions.Store("s-stream", &Session{ID: "s-stream", TestID: "t-stream", TargetURL: appium.URL, StartedAt: time.Now(), Owner: alice})
+	t.Cleanup(func() {
+		Sessions.Delete("s-stream")
+		ReverseProxyMap.Delete(appium.URL)
+	})
+
+	for _, path := range []string{"/bidi/s-stream", "/ws/session/s-stream/appium/device/logcat", "/mjpeg/s-stream"} {
+		w := httptest.NewRecorder()
+		StreamHandler(w, userRequest(http.MethodGet, path, bob))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s of another user's session answered %d, want 404", path, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	StreamHandler(w, userRequest(http.MethodGet, "/ws/session/s-stream/appium/device/logcat", alice))
+	if w.Code != http.StatusOK {
+		t.Errorf("stream of own session answered %d, want 200", w.Code)
+	}
+}
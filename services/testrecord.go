@@ -0,0 +1,197 @@
+package services
+
+import (
+	"byod/common"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// endReason tells why a session ended.
+type endReason string
+
+const (
+	endReasonClientDelete endReason = "client_delete"
+	endReasonTimeout      endReason = "timeout"
+	endReasonDeviceLost   endReason = "device_lost"
+	endReasonCrash        endReason = "crash"
+	endReasonNotCreated   endReason = "not_created"
+	endReasonKilled       endReason = "killed"
+)
+
+// Final and intermediate statuses of a test record.
+const (
+	testStatusStarting  = "starting"
+	testStatusRunning   = "running"
+	testStatusCompleted = "completed"
+	testStatusFailed    = "failed"
+)
+
+// testEvent is one lifecycle step of a test.
+type testEvent struct {
+	Time   time.Time `json:"time"`
+	Step   string    `json:"step"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// testOwner identifies the user who started a test.
+type testOwner struct {
+	UserID   int    `json:"userId"`
+	Username string `json:"username"`
+	OrgID    int    `json:"orgId"`
+}
+
+// testRecordData is the content of AppDirs.TestInfo/<testId>.json.
+type testRecordData struct {
+	TestID                string             `json:"testId"`
+	SessionID             string             `json:"sessionId,omitempty"`
+	UDID                  string             `json:"udid,omitempty"`
+	TestType              string             `json:"testType,omitempty"`
+	Owner                 testOwner          `json:"owner"`
+	Status                string             `json:"status"`
+	EndReason             endReason          `json:"endReason,omitempty"`
+	Error                 string             `json:"error,omitempty"`
+	RequestedCapabilities interface{}        `json:"requestedCapabilities,omitempty"`
+	EffectiveCapabilities interface{}        `json:"effectiveCapabilities,omitempty"`
+	Device                *common.DeviceInfo `json:"device,omitempty"`
+	AppiumPort            string             `json:"appiumPort,omitempty"`
+	AppiumLog             string             `json:"appiumLog,omitempty"`
+	CommandLog            string             `json:"commandLog,omitempty"`
+	Video                 string             `json:"video,omitempty"`
+	CreatedAt             time.Time          `json:"createdAt"`
+	StartedAt             *time.Time         `json:"startedAt,omitempty"`
+	EndedAt               *time.Time         `json:"endedAt,omitempty"`
+	Events                []testEvent        `json:"events"`
+}
+
+// testRecord keeps the lifecycle record of a test and rewrites its file atomically on every change.
+type testRecord struct {
+	mu   sync.Mutex
+	path string
+	data testRecordData
+}
+
+// newTestRecord creates the record of a test from its new-session request.
+func newTestRecord(testInfo common.TestInfo, owner common.UserDetails, body []byte) *testRecord {
+	record := &testRecord{
+		path: filepath.Join(common.AppDirs.TestInfo, testInfo.TestID+".json"),
+		data: testRecordData{
+			TestID:                testInfo.TestID,
+			UDID:                  testInfo.UDID,
+			TestType:              testInfo.TestType,
+			Owner:                 testOwner{UserID: owner.UserID, Username: owner.Username, OrgID: owner.OrgID},
+			Status:                testStatusStarting,
+			RequestedCapabilities: sanitizeRequestBody(body),
+			CreatedAt:             time.Now(),
+		},
+	}
+	record.update("requested", "", func(data *testRecordData) {})
+	return record
+}
+
+// testIDsMu makes checking the owner of a test id and creating its record atomic.
+var testIDsMu sync.Mutex
+
+// claimTestRecord creates the record of a test unless its id already belongs to another user.
+func claimTestRecord(testInfo common.TestInfo, owner common.UserDetails, body []byte) (*testRecord, error) {
+	testIDsMu.Lock()
+	defer testIDsMu.Unlock()
+	if previous, err := readTestOwner(testInfo.TestID); err == nil && previous.UserID != owner.UserID {
+		return nil, fmt.Errorf("testId %q belongs to another user", testInfo.TestID)
+	}
+	return newTestRecord(testInfo, owner, body), nil
+}
+
+// update applies a change, appends a lifecycle event and persists the record.
+func (r *testRecord) update(step, detail string, change func(data *testRecordData)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	change(&r.data)
+	r.data.Events = append(r.data.Events, testEvent{Time: time.Now(), Step: step, Detail: detail})
+	if err := r.write(); err != nil {
+		log.Printf("testRecord :: unable to write %s: %v\n", r.path, err)
+	}
+}
+
+// write replaces the record file through a rename so readers never see a partial file.
+func (r *testRecord) write() error {
+	data, err := json.MarshalIndent(r.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// deviceAllocated records the device the test runs on.
+func (r *testRecord) deviceAllocated(udid string) {
+	device, found := lookupDevice(udid)
+	r.update("device_allocated", udid, func(data *testRecordData) {
+		data.UDID = udid
+		if found {
+			data.Device = &device
+		}
+	})
+}
+
+// appiumStarted records the appium server serving the test.
+func (r *testRecord) appiumStarted(port string) {
+	r.update("appium_started", "port "+port, func(data *testRecordData) {
+		data.AppiumPort = port
+		data.AppiumLog = filepath.Join(common.AppDirs.AppiumLogs, data.TestID+".log")
+	})
+}
+
+// sessionCreated records the session returned by appium and the capabilities it accepted.
+func (r *testRecord) sessionCreated(session *Session, capabilities json.RawMessage) {
+	r.update("session_created", session.ID, func(data *testRecordData) {
+		data.SessionID = session.ID
+		data.Status = testStatusRunning
+		data.StartedAt = &session.StartedAt
+		if len(capabilities) > 0 {
+			data.EffectiveCapabilities = sanitizeRequestBody(capabilities)
+		}
+		if session.commandLog != nil {
+			data.CommandLog = session.commandLog.file.Name()
+		}
+		if session.recordVideo {
+			data.Video = filepath.Join(common.AppDirs.Videos, session.TestID+".mp4")
+		}
+	})
+}
+
+// failed records a test that never got a session.
+func (r *testRecord) failed(err error) {
+	now := time.Now()
+	r.update("failed", err.Error(), func(data *testRecordData) {
+		data.Status = testStatusFailed
+		data.EndReason = endReasonNotCreated
+		data.Error = err.Error()
+		data.EndedAt = &now
+	})
+}
+
+// ended records the end of the session and the final status of the test.
+func (r *testRecord) ended(reason endReason, detail string) {
+	now := time.Now()
+	if detail != "" {
+		detail = fmt.Sprintf("%s: %s", reason, detail)
+	} else {
+		detail = string(reason)
+	}
+	r.update("ended", detail, func(data *testRecordData) {
+		data.EndReason = reason
+		data.EndedAt = &now
+		data.Status = testStatusCompleted
+		if reason != endReasonClientDelete {
+			data.Status = testStatusFailed
+		}
+	})
+}
@@ -0,0 +1,27 @@
+package services
+
+import (
+	"byod/common"
+	"testing"
+)
+
+func TestTestIDBelongsToItsOwner(t *testing.T) {
+	dir := common.AppDirs.TestInfo
+	common.AppDirs.TestInfo = t.TempDir()
+	t.Cleanup(func() { common.AppDirs.TestInfo = dir })
+	alice := common.UserDetails{UserID: 1, Username: "alice", OrgID: 7}
+	bob := common.UserDetails{UserID: 2, Username: "bob", OrgID: 7}
+
+	if _, err := claimTestRecord(common.TestInfo{TestID: "checkout"}, alice, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := claimTestRecord(common.TestInfo{TestID: "checkout"}, bob, nil); err == nil {
+		t.Error("test id of another user reused")
+	}
+	if _, err := claimTestRecord(common.TestInfo{TestID: "checkout"}, alice, nil); err != nil {
+		t.Errorf("owner unable to rerun a test: %v", err)
+	}
+	if owner, _ := readTestOwner("checkout"); owner.UserID != alice.UserID {
+		t.Errorf("test record owned by %+v", owner)
+	}
+}
@@ -58,6 +58,13 @@ func ValidationHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	os, status := attachedDeviceOS(validationInfo.UDID, validationInfo.OS)
+	if status != http.StatusOK {
+		http.Error(w, `{"status":"invalid device"}`, status)
+		return
+	}
+	validationInfo.OS = os
+
 	// Set up proxy to forward the request to the appropriate device IP and port
 	deviceIP, port := getDeviceNetworkConfig(validationInfo.UDID, validationInfo.OS, validationInfo.Package)
 	targetURL, err := url.Parse(fmt.Sprintf("http://%s:%s", deviceIP, port))
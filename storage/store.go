@@ -5,7 +5,6 @@ import (
 	"encoding/gob"
 	"errors"
 	"log"
-	"os"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -22,20 +21,21 @@ var (
 	Store       *KVStore
 )
 
-func init() {
+// Init opens the store at path as the Store of the binary.
+// The store is kept across restarts so that port leases and device options survive them.
+func Init(path string) {
 	var err error
-	os.Remove("byod.db")
-	Store, err = Open()
+	Store, err = Open(path)
 	if err != nil {
-		log.Println("Unable to open byod.db")
+		log.Printf("Unable to open %s: %v\n", path, err)
 	}
 }
 
-func Open() (*KVStore, error) {
+func Open(path string) (*KVStore, error) {
 	opts := &bolt.Options{
 		Timeout: 50 * time.Millisecond,
 	}
-	if db, err := bolt.Open("byod.db", 0640, opts); err != nil {
+	if db, err := bolt.Open(path, 0640, opts); err != nil {
 		return nil, err
 	} else {
 		err := db.Update(func(tx *bolt.Tx) error {
@@ -0,0 +1,133 @@
+package watcher
+
+import (
+	"byod/common"
+	"byod/provider"
+	"log"
+	"strings"
+	"time"
+)
+
+var (
+	networkTick          = time.Second      // time between two looks at the network devices due
+	networkCheckInterval = 10 * time.Second // time between two checks of a connected network device
+	minReconnectBackoff  = 5 * time.Second  // wait after the first failed connection
+	maxReconnectBackoff  = 5 * time.Minute  // longest wait between two connections
+)
+
+// networkAddresses are the host:port of the network devices configured on the host.
+var networkAddresses []string
+
+// SetNetworkDevices sets the host:port of the Android devices kept connected over the network.
+func SetNetworkDevices(addresses []string) error {
+	networkAddresses = nil
+	for _, address := range addresses {
+		if address = strings.TrimSpace(address); address == "" {
+			continue
+		}
+		if err := provider.CheckAddress(address); err != nil {
+			return err
+		}
+		networkAddresses = append(networkAddresses, address)
+	}
+	return nil
+}
+
+// networkDevice is the connection schedule of a managed network device.
+type networkDevice struct {
+	next    time.Time     // next connection check
+	backoff time.Duration // wait after the next failed connection
+}
+
+// AddNetworkDevice keeps the device at address connected, as the configured network devices.
+func (dw *DeviceWatcher) AddNetworkDevice(address string) error {
+	if err := provider.CheckAddress(address); err != nil {
+		return err
+	}
+	dw.networkMu.Lock()
+	defer dw.networkMu.Unlock()
+	if _, ok := dw.network[address]; !ok {
+		dw.network[address] = &networkDevice{backoff: minReconnectBackoff}
+		log.Printf("AddNetworkDevice :: keeping %s connected\n", address)
+	}
+	return nil
+}
+
+// keepConnected connects the network devices missing from the adb server, backing off after every failed connection.
+func (dw *DeviceWatcher) keepConnected(stopChan chan struct{}) {
+	defer common.WG.Done()
+	p, ok := dw.providers["android"]
+	if !ok {
+		return
+	}
+	connector, ok := p.(provider.NetworkConnector)
+	if !ok {
+		return
+	}
+	for {
+		select {
+		case <-stopChan:
+			log.Println("keepConnected :: received termination signal... exiting")
+			return
+		case <-time.After(networkTick):
+			dw.connectNetworkDevices(p, connector)
+		}
+	}
+}
+
+// connectNetworkDevices checks the network devices due and connects the ones the adb server does not list.
+func (dw *DeviceWatcher) connectNetworkDevices(p provider.DeviceProvider, connector provider.NetworkConnector) {
+	due := dw.dueNetworkDevices(time.Now())
+	if len(due) == 0 {
+		return
+	}
+	serials, err := p.List()
+	if err != nil {
+		log.Println("connectNetworkDevices :: unable to list devices: ", err)
+		return
+	}
+	attached := make(map[string]bool)
+	for _, serial := range serials {
+		attached[serial] = true
+	}
+	for _, address := range due {
+		var err error
+		if !attached[address] {
+			if err = connector.Connect(address); err != nil {
+				log.Printf("connectNetworkDevices :: unable to connect %s: %v\n", address, err)
+			} else {
+				log.Println("connectNetworkDevices :: connected", address)
+			}
+		}
+		dw.scheduleNetworkDevice(address, err == nil)
+	}
+}
+
+// dueNetworkDevices returns the network devices whose next check has come.
+func (dw *DeviceWatcher) dueNetworkDevices(now time.Time) []string {
+	dw.networkMu.Lock()
+	defer dw.networkMu.Unlock()
+	var due []string
+	for address, device := range dw.network {
+		if !now.Before(device.next) {
+			due = append(due, address)
+		}
+	}
+	return due
+}
+
+// scheduleNetworkDevice plans the next check of a network device, doubling the wait after every failed connection.
+func (dw *DeviceWatcher) scheduleNetworkDevice(address string, connected bool) {
+	dw.networkMu.Lock()
+	defer dw.networkMu.Unlock()
+	device := dw.network[address]
+	if connected {
+		device.next = time.Now().Add(networkCheckInterval)
+		device.backoff = minReconnectBackoff
+		return
+	}
+	device.next = time.Now().Add(device.backoff)
+	if device.backoff *= 2; device.backoff > maxReconnectBackoff {
+		device.backoff = maxReconnectBackoff
+	}
+}
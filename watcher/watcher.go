@@ -2,56 +2,91 @@ package watcher
 
 import (
 	"byod/common"
+	"byod/ports"
+	"byod/provider"
+	"byod/quarantine"
+	"byod/registry"
 	"byod/remote"
 	"byod/services"
-	"byod/storage"
 	"encoding/json"
 	"fmt"
 	"log"
-	"os"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
-	"github.com/danielpaulus/go-ios/ios"
 	adb "github.com/zach-klippenstein/goadb"
 )
 
-type HostInfo struct {
-	IsSyncHost                bool         `json:"is_sync_host"`
-	HostIP                    string       `json:"host_ip"`
-	HostPort                  int          `json:"host_port"`
-	DiscoveryTunnelIdentifier string       `json:"discovery_tunnel_identifier"`
-	HostType                  string       `json:"host_type"`
-	HostUserID                string       `json:"host_user_id"`
-	DedicatedOrg              string       `json:"dedicated_org"`
-	Devices                   []DeviceInfo `json:"devices"`
+const (
+	hotBatteryCelsius = 45.0    // battery temperature reported as a warning
+	lowBatteryPercent = 15      // battery level reported as a warning
+	lowStorageBytes   = 1 << 30 // free storage reported as a warning
+)
+
+// healthInterval is the time between two health readings of every device.
+var healthInterval = 2 * time.Minute
+
+// SetHealthInterval sets the time between two health readings of every device.
+func SetHealthInterval(interval time.Duration) {
+	if interval > 0 {
+		healthInterval = interval
+	}
 }
 
-type DeviceInfo struct {
-	OS            string `json:"os"`
-	Name          string `json:"name"`
-	UDID          string `json:"udid"`
-	Brand         string `json:"brand"`
-	Status        string `json:"status"`
-	OSVersion     string `json:"os_version"`
-	FullOSVersion string `json:"full_os_version"`
+type HostInfo struct {
+	IsSyncHost                bool                `json:"is_sync_host"`
+	HostIP                    string              `json:"host_ip"`
+	HostPort                  int                 `json:"host_port"`
+	DiscoveryTunnelIdentifier string              `json:"discovery_tunnel_identifier"`
+	HostType                  string              `json:"host_type"`
+	HostUserID                string              `json:"host_user_id"`
+	DedicatedOrg              string              `json:"dedicated_org"`
+	Devices                   []common.DeviceInfo `json:"devices"`
 }
 
 type DeviceWatcher struct {
-	HostIP     string
-	TunnelID   string
-	AdbClient  *adb.Adb
-	OldDevices map[string]DeviceInfo
+	HostIP    string // guarded by hostMu once the watcher runs
+	TunnelID  string // guarded by hostMu once the watcher runs
+	AdbClient *adb.Adb
+
+	registry   *registry.Registry
+	quarantine *quarantine.Tracker
+	providers  map[string]provider.DeviceProvider
+
+	hostMu    sync.RWMutex
+	networkMu sync.Mutex
+	network   map[string]*networkDevice // host:port of the network devices kept connected
 }
 
 func NewDeviceWatcher() (*DeviceWatcher, error) {
 	client, _ := adb.NewWithConfig(adb.ServerConfig{Port: 5037})
-	return &DeviceWatcher{
-		HostIP:     common.GetOutboundIP(),
-		OldDevices: make(map[string]DeviceInfo),
-		AdbClient:  client,
-	}, nil
+	dw := newDeviceWatcher(registry.Default, provider.NewAndroid(client), provider.NewIOS())
+	dw.quarantine = quarantine.Default
+	services.SetDevicePreparer(dw.Reprepare)
+	services.SetNetworkDeviceAdder(dw.AddNetworkDevice)
+	dw.HostIP = common.GetOutboundIP()
+	dw.AdbClient = client
+	return dw, nil
+}
+
+// newDeviceWatcher returns a watcher keeping the devices of the providers in the registry.
+// The providers are registered for app operations.
+func newDeviceWatcher(devices *registry.Registry, providers ...provider.DeviceProvider) *DeviceWatcher {
+	dw := &DeviceWatcher{
+		registry:   devices,
+		quarantine: quarantine.New(devices),
+		providers:  make(map[string]provider.DeviceProvider),
+		network:    make(map[string]*networkDevice),
+	}
+	for _, address := range networkAddresses {
+		dw.network[address] = &networkDevice{backoff: minReconnectBackoff}
+	}
+	for _, p := range providers {
+		dw.providers[p.Platform()] = p
+		provider.Register(p)
+	}
+	return dw
 }
 
 func (dw *DeviceWatcher) Watch(stopChan chan struct{}) {
@@ -63,6 +98,9 @@ func (dw *DeviceWatcher) Watch(stopChan chan struct{}) {
 	common.WG.Add(1)
 	go dw.watchDevices(stopChan)
 
+	common.WG.Add(1)
+	go dw.monitorHealth(stopChan)
+
 	common.WG.Add(1)
 	dw.keepAlive(stopChan)
 }
@@ -71,110 +109,253 @@ func (dw *DeviceWatcher) watchDevices(stopChan chan struct{}) {
 	log.Println("starting watchDevices.....")
 	defer common.WG.Done()
 
+	for {
+		if tunnelID, _ := dw.host(); tunnelID != "" {
+			break
+		}
+		tunnelId, err := remote.GetTunnelId()
+		if err == nil {
+			dw.hostMu.Lock()
+			dw.TunnelID = tunnelId
+			dw.hostMu.Unlock()
+			break
+		}
+		select {
+		case <-stopChan:
+			log.Println("watchDevices :: received termination signal... exiting")
+			return
+		case <-time.After(3 * time.Second):
+		}
+	}
+
+	changes, unsubscribe := dw.registry.Subscribe()
+	common.WG.Add(1)
+	go dw.syncDevices(stopChan, changes, unsubscribe)
+
+	dw.retainLeases()
+	events := make(chan provider.Event)
+	for _, p := range dw.providers {
+		go p.Watch(stopChan, events)
+	}
+	common.WG.Add(1)
+	go dw.keepConnected(stopChan)
 	for {
 		select {
 		case <-stopChan:
 			log.Println("watchDevices :: received termination signal... exiting")
 			return
-		default:
-			tunnelId, err := remote.GetTunnelId()
-			if err != nil {
-				time.Sleep(3 * time.Second)
+		case event := <-events:
+			dw.handleEvent(event)
+		}
+	}
+}
+
+// handleEvent applies a provider event, reading the properties and preparing the device once per attach.
+func (dw *DeviceWatcher) handleEvent(event provider.Event) {
+	if event.Gone {
+		dw.detach(event.UDID)
+		return
+	}
+	p, ok := dw.providers[event.Platform]
+	if !ok {
+		return
+	}
+
+	device, known := dw.lookup(event.UDID)
+	if !known {
+		device = dw.detect(event.Platform, event.UDID)
+	}
+	if !event.Online {
+		if known {
+			dw.recordDisconnect(device)
+			dw.registry.Transition(event.UDID, common.StateOffline, "device stopped answering")
+		}
+		return
+	}
+	dw.seen(event.UDID)
+	if device.State != common.StatePreparing {
+		go dw.prepare(p, event.UDID, device.Name == "")
+	}
+}
+
+// detect records a newly attached device in the detected state.
+func (dw *DeviceWatcher) detect(platform, udid string) common.DeviceInfo {
+	device := common.DeviceInfo{OS: platform, UDID: udid, HealthScore: dw.quarantine.Score(udid)}
+	device.Transition(common.StateDetected, "attached", time.Now())
+	if err := dw.registry.Add(device); err != nil {
+		log.Println("detect :: ", err)
+	}
+
+	dw.leasePorts(udid)
+	log.Println("Connected:", udid)
+	return device
+}
+
+// prepare provisions an online device, reading its properties when not cached, and marks it ready or unhealthy.
+func (dw *DeviceWatcher) prepare(p provider.DeviceProvider, udid string, readProperties bool) {
+	if err := dw.registry.Transition(udid, common.StatePreparing, "device online"); err != nil {
+		log.Println("prepare :: ", err)
+		return
+	}
+	if readProperties {
+		properties, err := p.Properties(udid)
+		if err != nil {
+			log.Println("prepare :: unable to read properties of", udid, ":", err)
+		}
+		dw.registry.Update(udid, func(device *common.DeviceInfo) error {
+			device.Name = properties.Name
+			device.Brand = properties.Brand
+			device.Model = properties.Model
+			device.OSVersion = properties.OSVersion
+			device.FullOSVersion = properties.FullOSVersion
+			device.Transport = properties.Transport
+			return nil
+		})
+	}
+
+	device, ok := dw.lookup(udid)
+	if !ok {
+		return
+	}
+	if err := p.Prepare(device); err != nil {
+		log.Println("prepare :: unable to prepare", udid, ":", err)
+		dw.registry.Transition(udid, common.StateUnhealthy, err.Error())
+		return
+	}
+	dw.quarantine.Admit(udid, "prepared")
+}
+
+// Reprepare provisions an attached device again, as after a recovery step.
+func (dw *DeviceWatcher) Reprepare(udid string) error {
+	device, ok := dw.lookup(udid)
+	if !ok {
+		return fmt.Errorf("device %s is not attached", udid)
+	}
+	p, ok := dw.providers[device.OS]
+	if !ok {
+		return fmt.Errorf("no provider for %s", device.OS)
+	}
+	dw.prepare(p, udid, device.Name == "")
+	return nil
+}
+
+// detach moves a device reported gone by a discovery stream to offline and forgets it.
+func (dw *DeviceWatcher) detach(udid string) {
+	device, known := dw.lookup(udid)
+	if !known {
+		return
+	}
+	dw.recordDisconnect(device)
+	if device.State != common.StateOffline {
+		dw.registry.Transition(udid, common.StateOffline, "detached")
+	}
+	dw.registry.Remove(udid)
+
+	log.Println("Disconnected:", udid)
+	ports.Release(udid)
+}
+
+// recordDisconnect counts a device lost during a session against its health score.
+func (dw *DeviceWatcher) recordDisconnect(device common.DeviceInfo) {
+	if device.State == common.StateInSession {
+		dw.quarantine.Record(device.UDID, quarantine.Disconnected)
+	}
+}
+
+// seen records that the device answered its provider just now.
+func (dw *DeviceWatcher) seen(udid string) {
+	dw.registry.Update(udid, func(device *common.DeviceInfo) error {
+		device.LastSeen = time.Now()
+		return nil
+	})
+}
+
+// refreshDevices marks the devices still listed by their provider as seen and reads the health of the online ones.
+// The readings are part of the next keep-alive sync.
+func (dw *DeviceWatcher) refreshDevices() {
+	for platform, p := range dw.providers {
+		udids, err := p.List()
+		if err != nil {
+			log.Println("refreshDevices :: unable to list", platform, "devices: ", err)
+			continue
+		}
+		for _, udid := range udids {
+			device, ok := dw.lookup(udid)
+			if !ok || device.OS != platform || device.State == common.StateOffline {
 				continue
 			}
-			dw.TunnelID = tunnelId
-			dw.HostIP = common.GetOutboundIP() // Update IP if needed
-			newDevices := make(map[string]DeviceInfo)
-			devices, err := ios.ListDevices()
+			health, err := p.Health(udid)
 			if err != nil {
-				log.Println("Failed to list iOS devices:", err)
-			} else {
-				for _, device := range devices.DeviceList {
-					udid := device.Properties.SerialNumber
-					deviceInfo := DeviceInfo{
-						OS:     "ios",
-						UDID:   udid,
-						Status: "connected",
-					}
-					values, _ := ios.GetValues(device)
-					deviceInfo.Name = values.Value.DeviceName
-					deviceInfo.Brand = values.Value.DeviceClass
-					deviceInfo.FullOSVersion = values.Value.ProductVersion
-					deviceInfo.OSVersion = strings.Split(deviceInfo.FullOSVersion, ".")[0]
-					newDevices[udid] = deviceInfo
-					err = dw.syncDiskImages(udid, deviceInfo.FullOSVersion)
-					if err == nil {
-						deviceInfo.Status = "ready"
-					}
-				}
+				log.Println("refreshDevices :: unable to read health of", udid, ":", err)
 			}
-
-			androidDevices, err := dw.AdbClient.ListDeviceSerials()
-			if err != nil {
-				log.Println("Failed to list Android devices:", err)
-			} else {
-				for _, udid := range androidDevices {
-					deviceInfo := DeviceInfo{
-						OS:     "android",
-						UDID:   udid,
-						Status: "connected",
-					}
-
-					device := dw.AdbClient.Device(adb.DeviceWithSerial(udid))
-					state, _ := device.State()
-					if state.String() == "StateOnline" {
-						deviceInfo.Status = "ready"
-					}
-					deviceInfo.Name, _ = device.RunCommand("getprop ro.product.model")
-					deviceInfo.Name = strings.Trim(deviceInfo.Name, "\n")
-
-					deviceInfo.Brand, _ = device.RunCommand("getprop ro.product.brand")
-					deviceInfo.Brand = strings.Trim(deviceInfo.Brand, "\n")
-
-					deviceInfo.OSVersion, _ = device.RunCommand("getprop ro.build.version.release")
-					deviceInfo.OSVersion = strings.Trim(deviceInfo.OSVersion, "\n")
-
-					deviceInfo.FullOSVersion = deviceInfo.OSVersion
-					newDevices[udid] = deviceInfo
-				}
+			health.Warnings = healthWarnings(health)
+			for _, warning := range health.Warnings {
+				log.Println("refreshDevices :: warning for", udid, ":", warning)
 			}
-
-			for udid, device := range dw.OldDevices {
-				if _, ok := newDevices[udid]; !ok {
-					log.Println("Disconnected:", udid)
-					device.Status = "disconnected"
-					go dw.sync(false, []DeviceInfo{device})
+			dw.registry.Update(udid, func(device *common.DeviceInfo) error {
+				device.LastSeen = time.Now()
+				if err == nil {
+					device.Health = health
 				}
-			}
+				return nil
+			})
+		}
+	}
+}
 
-			for udid, device := range newDevices {
-				oldDevice, ok := dw.OldDevices[udid]
-				if !ok {
-					dw.setAppiumPort(udid)
-					log.Println("Connected:", udid)
-					go dw.sync(false, []DeviceInfo{device})
-					if device.OS == "ios" {
-						go dw.installRunner(udid)
-					}
-				} else if oldDevice.OS == "android" && oldDevice.Status != device.Status {
-					go dw.sync(false, []DeviceInfo{device})
-				}
-			}
-			dw.OldDevices = newDevices
-			time.Sleep(3 * time.Second)
+// healthWarnings lists the readings that need attention before they damage or block the device.
+func healthWarnings(health common.DeviceHealth) []string {
+	if health.CollectedAt.IsZero() {
+		return nil
+	}
+	var warnings []string
+	if health.BatteryTemperature >= hotBatteryCelsius {
+		warnings = append(warnings, fmt.Sprintf("battery temperature %.1f°C", health.BatteryTemperature))
+	}
+	if health.BatteryLevel <= lowBatteryPercent && !health.Charging {
+		warnings = append(warnings, fmt.Sprintf("battery at %d%% and not charging", health.BatteryLevel))
+	}
+	if health.StorageTotal > 0 && health.StorageFree < lowStorageBytes {
+		warnings = append(warnings, fmt.Sprintf("%d MB of storage left", health.StorageFree>>20))
+	}
+	return warnings
+}
+
+// monitorHealth refreshes the health of the devices every health interval.
+func (dw *DeviceWatcher) monitorHealth(stopChan chan struct{}) {
+	defer common.WG.Done()
+	for {
+		select {
+		case <-stopChan:
+			log.Println("monitorHealth :: received termination signal... exiting")
+			return
+		case <-time.After(healthInterval):
+			dw.refreshDevices()
 		}
 	}
 }
 
-func (dw *DeviceWatcher) installRunner(udid string) {
-	runner := fmt.Sprintf("%s/WebDriverAgentRunner-Runner.app", common.AppDirs.Assets)
-	command := fmt.Sprintf("%s install --path=%s --udid %s", common.GoIOS, runner, udid)
-	_, err := common.Execute(command)
-	if err != nil {
-		log.Println("error while installing runner: ", err.Error())
+// syncDevices posts the state changes of the registry in the order they happened.
+func (dw *DeviceWatcher) syncDevices(stopChan chan struct{}, changes <-chan registry.Event, unsubscribe func()) {
+	defer common.WG.Done()
+	defer unsubscribe()
+	for {
+		select {
+		case <-stopChan:
+			return
+		case event := <-changes:
+			if event.Type != registry.Removed && event.StateChanged() {
+				dw.sync(false, []common.DeviceInfo{event.Device})
+			}
+		}
 	}
 }
 
+// lookup returns the snapshot of an attached device.
+func (dw *DeviceWatcher) lookup(udid string) (common.DeviceInfo, bool) {
+	return dw.registry.Get(udid)
+}
+
 func (dw *DeviceWatcher) launchTunnel() {
 	defer common.WG.Done()
 	log.Println("starting GoIoS launch tunnel.....")
@@ -188,18 +369,30 @@ func (dw *DeviceWatcher) launchTunnel() {
 	}
 }
 
-func (dw *DeviceWatcher) setAppiumPort(udid string) {
-	var port string
-	storage.Store.Get("Appium_Port_"+udid, &port)
-	if port == "" {
-		storage.Store.Put("Appium_Port_"+udid, common.BaseAppiumPort)
-		port, _ := strconv.Atoi(common.BaseAppiumPort)
-		common.BaseAppiumPort = fmt.Sprintf("%d", (port + 1))
+// leasePorts reserves the appium, driver and stream ports of a newly connected device.
+func (dw *DeviceWatcher) leasePorts(udid string) {
+	if _, err := ports.Acquire(udid); err != nil {
+		log.Println("leasePorts :: unable to lease ports for", udid, ":", err)
+	}
+}
+
+// retainLeases drops the persisted port leases of the devices that did not come back since the last run.
+// The configured network devices keep theirs, they are connected shortly after. Nothing is dropped when a provider cannot list its devices.
+func (dw *DeviceWatcher) retainLeases() {
+	attached := append([]string(nil), networkAddresses...)
+	for platform, p := range dw.providers {
+		udids, err := p.List()
+		if err != nil {
+			log.Println("retainLeases :: unable to list", platform, "devices, keeping every lease: ", err)
+			return
+		}
+		attached = append(attached, udids...)
 	}
+	ports.Retain(attached)
 }
 
-func (dw *DeviceWatcher) sync(isSync bool, devices []DeviceInfo) {
-	tunnelId := dw.TunnelID
+func (dw *DeviceWatcher) sync(isSync bool, devices []common.DeviceInfo) {
+	tunnelId, hostIP := dw.host()
 	if tunnelId == "" {
 		var err error
 		tunnelId, err = remote.GetTunnelId()
@@ -210,7 +403,7 @@ func (dw *DeviceWatcher) sync(isSync bool, devices []DeviceInfo) {
 	}
 	hostInfo := HostInfo{
 		IsSyncHost:                isSync,
-		HostIP:                    common.GetOutboundIP(),
+		HostIP:                    hostIP,
 		HostPort:                  4723,
 		DiscoveryTunnelIdentifier: tunnelId,
 		HostType:                  common.OS(),
@@ -245,29 +438,29 @@ func (dw *DeviceWatcher) keepAlive(stopChan chan struct{}) {
 			return
 		default:
 			time.Sleep(60 * time.Second)
-			var devices []DeviceInfo
-			for _, device := range dw.OldDevices {
-				devices = append(devices, device)
-			}
-			dw.sync(true, devices)
+			dw.refreshHost()
+			dw.sync(true, dw.registry.List())
 		}
 	}
 }
 
-func (dw *DeviceWatcher) syncDiskImages(udid, version string) error {
-	diskImagesPath := fmt.Sprintf("%s/%s", common.AppDirs.DiskImages, version)
-	_, err := os.Stat(diskImagesPath)
+// refreshHost updates the tunnel ID and outbound IP reported in syncs.
+func (dw *DeviceWatcher) refreshHost() {
+	tunnelId, err := remote.GetTunnelId()
+	hostIP := common.GetOutboundIP()
+	dw.hostMu.Lock()
+	defer dw.hostMu.Unlock()
 	if err == nil {
-		return nil
+		dw.TunnelID = tunnelId
 	}
+	dw.HostIP = hostIP
+}
 
-	source := fmt.Sprintf("%s/diskimages/%s.zip", common.SanitisatioEndpoint, version)
-	target := fmt.Sprintf("%s/%s.zip", common.AppDirs.DiskImages, version)
-	common.Download(source, target)
-	common.Unzip(target, common.AppDirs.DiskImages)
-
-	_, err = common.Execute(fmt.Sprintf("%s image auto --basedir=%s/diskimages --udid %s", common.GoIOS, common.AppDirs.Assets, udid))
-	return err
+// host returns the tunnel ID and outbound IP reported in syncs.
+func (dw *DeviceWatcher) host() (string, string) {
+	dw.hostMu.RLock()
+	defer dw.hostMu.RUnlock()
+	return dw.TunnelID, dw.HostIP
 }
 
 // binary host sync call at start and stop
@@ -290,7 +483,7 @@ func SyncBinaryHost(retry int) {
 		HostType:                  common.OS(),
 		HostUserID:                strconv.Itoa(common.UserInfo.UserID),
 		DedicatedOrg:              strconv.Itoa(common.UserInfo.Organization.OrgID),
-		Devices:                   []DeviceInfo{},
+		Devices:                   []common.DeviceInfo{},
 	}
 	jsonInfo, err := json.Marshal(hostInfo)
 	if err != nil {
@@ -0,0 +1,424 @@
+package watcher
+
+import (
+	"byod/common"
+	"byod/ports"
+	"byod/provider"
+	"byod/registry"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const waitTimeout = 5 * time.Second
+
+// syncRecorder collects the payloads posted to the sync endpoint.
+type syncRecorder struct {
+	mu       sync.Mutex
+	payloads []HostInfo
+}
+
+// newSyncRecorder points the sync endpoint at a test server for the duration of the test.
+func newSyncRecorder(t *testing.T) *syncRecorder {
+	t.Helper()
+	recorder := &syncRecorder{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var hostInfo HostInfo
+		if err := json.NewDecoder(r.Body).Decode(&hostInfo); err != nil {
+			t.Errorf("sync payload is not valid JSON: %v", err)
+			return
+		}
+		recorder.mu.Lock()
+		recorder.payloads = append(recorder.payloads, hostInfo)
+		recorder.mu.Unlock()
+	}))
+	endpoint := common.SyncEndpoint
+	common.SyncEndpoint = server.URL
+	t.Cleanup(func() {
+		common.SyncEndpoint = endpoint
+		server.Close()
+	})
+	return recorder
+}
+
+// waitFor returns the first payload syncing the device with the given status.
+func (r *syncRecorder) waitFor(t *testing.T, udid, status string) HostInfo {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for time.Now().Before(deadline) {
+		if hostInfo, ok := r.find(udid, status); ok {
+			return hostInfo
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no sync of %s with status %q, got %+v", udid, status, r.all())
+	return HostInfo{}
+}
+
+// find returns the first payload syncing the device with the given status.
+func (r *syncRecorder) find(udid, status string) (HostInfo, bool) {
+	for _, hostInfo := range r.all() {
+		for _, device := range hostInfo.Devices {
+			if device.UDID == udid && device.Status == status {
+				return hostInfo, true
+			}
+		}
+	}
+	return HostInfo{}, false
+}
+
+func (r *syncRecorder) all() []HostInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]HostInfo(nil), r.payloads...)
+}
+
+// startWatcher runs the watcher over the providers until the test ends.
+func startWatcher(t *testing.T, providers ...provider.DeviceProvider) *DeviceWatcher {
+	t.Helper()
+	dw := newDeviceWatcher(registry.New(), providers...)
+	dw.TunnelID = "tunnel-test"
+	dw.HostIP = "10.0.0.7"
+
+	stopChan := make(chan struct{})
+	common.WG.Add(1)
+	go dw.watchDevices(stopChan)
+	t.Cleanup(func() {
+		close(stopChan)
+		common.WG.Wait()
+	})
+	return dw
+}
+
+// waitForState waits until the watcher reports the device in the given state.
+func waitForState(t *testing.T, dw *DeviceWatcher, udid string, state common.DeviceState) common.DeviceInfo {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for time.Now().Before(deadline) {
+		if device, ok := dw.lookup(udid); ok && device.State == state {
+			return device
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	device, _ := dw.lookup(udid)
+	t.Fatalf("device %s not %q, got %+v", udid, state, device)
+	return common.DeviceInfo{}
+}
+
+func equalStates(got, want []common.DeviceState) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func countCalls(calls []string, prefix string) int {
+	count := 0
+	for _, call := range calls {
+		if strings.HasPrefix(call, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestAttachPreparesAndSyncsReadyDevice(t *testing.T) {
+	syncs := newSyncRecorder(t)
+	fake := provider.NewFake("android")
+	dw := startWatcher(t, fake)
+
+	fake.Attach(common.DeviceInfo{UDID: "android-1", Name: "Pixel 7", Brand: "google", OSVersion: "14", FullOSVersion: "14"})
+
+	device := waitForState(t, dw, "android-1", common.StateReady)
+	if device.OS != "android" || device.Name != "Pixel 7" || device.Brand != "google" {
+		t.Errorf("unexpected device info %+v", device)
+	}
+	if calls := fake.Calls(); countCalls(calls, "prepare android-1") != 1 {
+		t.Errorf("device prepared %d times, calls %v", countCalls(calls, "prepare android-1"), calls)
+	}
+	if !dw.registry.Contains("android-1") {
+		t.Error("attached device not reported connected")
+	}
+
+	hostInfo := syncs.waitFor(t, "android-1", "ready")
+	if hostInfo.IsSyncHost {
+		t.Error("device change synced as a host sync")
+	}
+	if hostInfo.DiscoveryTunnelIdentifier != "tunnel-test" || hostInfo.HostIP != "10.0.0.7" || hostInfo.HostPort != 4723 {
+		t.Errorf("unexpected host fields %+v", hostInfo)
+	}
+	if len(hostInfo.Devices) != 1 || hostInfo.Devices[0].Name != "Pixel 7" || hostInfo.Devices[0].OSVersion != "14" {
+		t.Errorf("unexpected devices in payload %+v", hostInfo.Devices)
+	}
+	var states []common.DeviceState
+	for _, payload := range syncs.all() {
+		states = append(states, payload.Devices[0].State)
+	}
+	if want := []common.DeviceState{common.StateDetected, common.StatePreparing, common.StateReady}; !equalStates(states, want) {
+		t.Errorf("synced states %v, want %v", states, want)
+	}
+	if hostInfo.Devices[0].PreviousState != common.StatePreparing || hostInfo.Devices[0].StateSince.IsZero() {
+		t.Errorf("ready sync without transition details %+v", hostInfo.Devices[0])
+	}
+	if _, ok := ports.Lookup("android-1"); !ok {
+		t.Error("no ports leased to the attached device")
+	}
+}
+
+func TestFailedPreparationMarksDeviceUnhealthy(t *testing.T) {
+	syncs := newSyncRecorder(t)
+	fake := provider.NewFake("ios")
+	fake.FailPrepare("ios-1", errors.New("disk image missing"))
+	dw := startWatcher(t, fake)
+
+	fake.Attach(common.DeviceInfo{UDID: "ios-1", Name: "iPhone", FullOSVersion: "17.4", OSVersion: "17"})
+
+	device := waitForState(t, dw, "ios-1", common.StateUnhealthy)
+	if device.StateReason != "disk image missing" || device.Status != "connected" {
+		t.Errorf("unexpected unhealthy device %+v", device)
+	}
+	syncs.waitFor(t, "ios-1", "connected")
+	if _, ok := syncs.find("ios-1", "ready"); ok {
+		t.Error("device with failed preparation synced as ready")
+	}
+	if err := dw.registry.Transition("ios-1", common.StateInSession, "test"); err == nil {
+		t.Error("unhealthy device accepted a session")
+	}
+}
+
+func TestOfflineDeviceReturnsWithoutRereadingProperties(t *testing.T) {
+	syncs := newSyncRecorder(t)
+	fake := provider.NewFake("android")
+	dw := startWatcher(t, fake)
+
+	fake.Attach(common.DeviceInfo{UDID: "android-2", Name: "Galaxy"})
+	waitForState(t, dw, "android-2", common.StateReady)
+
+	fake.SetOnline("android-2", false)
+	device := waitForState(t, dw, "android-2", common.StateOffline)
+	if device.Name != "Galaxy" {
+		t.Errorf("offline device lost its properties: %+v", device)
+	}
+	syncs.waitFor(t, "android-2", "disconnected")
+
+	fake.SetOnline("android-2", true)
+	waitForState(t, dw, "android-2", common.StateReady)
+	if count := countCalls(fake.Calls(), "properties android-2"); count != 1 {
+		t.Errorf("properties read %d times for one attach", count)
+	}
+}
+
+func TestDetachSyncsDisconnectedAndReleasesPorts(t *testing.T) {
+	syncs := newSyncRecorder(t)
+	fake := provider.NewFake("android")
+	dw := startWatcher(t, fake)
+
+	fake.Attach(common.DeviceInfo{UDID: "android-3", Name: "Moto"})
+	waitForState(t, dw, "android-3", common.StateReady)
+
+	fake.Detach("android-3")
+	hostInfo := syncs.waitFor(t, "android-3", "disconnected")
+	if hostInfo.Devices[0].Name != "Moto" {
+		t.Errorf("disconnected sync lost the device info %+v", hostInfo.Devices[0])
+	}
+	if dw.registry.Contains("android-3") {
+		t.Error("detached device still reported connected")
+	}
+	if _, ok := ports.Lookup("android-3"); ok {
+		t.Error("ports of the detached device not released")
+	}
+}
+
+func TestHostSyncReportsAllDevices(t *testing.T) {
+	syncs := newSyncRecorder(t)
+	android := provider.NewFake("android")
+	ios := provider.NewFake("ios")
+	dw := startWatcher(t, android, ios)
+
+	android.Attach(common.DeviceInfo{UDID: "android-4"})
+	ios.Attach(common.DeviceInfo{UDID: "ios-4"})
+	waitForState(t, dw, "android-4", common.StateReady)
+	waitForState(t, dw, "ios-4", common.StateReady)
+
+	dw.sync(true, dw.registry.List())
+	var hostSync *HostInfo
+	for _, hostInfo := range syncs.all() {
+		if hostInfo.IsSyncHost {
+			found := hostInfo
+			hostSync = &found
+		}
+	}
+	if hostSync == nil {
+		t.Fatal("no host sync posted")
+	}
+	if len(hostSync.Devices) != 2 {
+		t.Errorf("host sync reports %d devices, want 2", len(hostSync.Devices))
+	}
+	for _, device := range hostSync.Devices {
+		if device.Status != "ready" {
+			t.Errorf("device %s synced as %q", device.UDID, device.Status)
+		}
+	}
+}
+
+func TestProvidersServeAppOperations(t *testing.T) {
+	fake := provider.NewFake("ios")
+	newDeviceWatcher(registry.New(), fake)
+
+	p, ok := provider.Get("ios")
+	if !ok || p != fake {
+		t.Fatal("watcher providers not registered for app operations")
+	}
+	if err := p.InstallApp("ios-5", "/tmp/app.ipa"); err == nil {
+		t.Error("install on a detached device succeeded")
+	}
+}
+
+func TestSessionTransitions(t *testing.T) {
+	newSyncRecorder(t)
+	fake := provider.NewFake("android")
+	dw := startWatcher(t, fake)
+
+	fake.Attach(common.DeviceInfo{UDID: "android-6", Name: "Nokia"})
+	waitForState(t, dw, "android-6", common.StateReady)
+
+	steps := []struct {
+		to    common.DeviceState
+		valid bool
+	}{
+		{common.StateCleaning, false},
+		{common.StateInSession, true},
+		{common.StateReady, false},
+		{common.StateCleaning, true},
+		{common.StateInSession, false},
+		{common.StateReady, true},
+	}
+	for _, step := range steps {
+		err := dw.registry.Transition("android-6", step.to, "test")
+		if step.valid && err != nil {
+			t.Errorf("transition to %s refused: %v", step.to, err)
+		}
+		if !step.valid && err == nil {
+			t.Errorf("invalid transition to %s accepted", step.to)
+		}
+	}
+	if device, _ := dw.lookup("android-6"); device.State != common.StateReady || device.Status != "ready" {
+		t.Errorf("device not back to ready %+v", device)
+	}
+	if err := dw.registry.Transition("missing", common.StateReady, "test"); err == nil {
+		t.Error("transition of an unknown device accepted")
+	}
+}
+
+func TestRefreshRecordsHealthAndLastSeen(t *testing.T) {
+	newSyncRecorder(t)
+	fake := provider.NewFake("android")
+	dw := startWatcher(t, fake)
+
+	fake.Attach(common.DeviceInfo{UDID: "android-7", Name: "Pixel 6", Model: "Pixel 6"})
+	attached := waitForState(t, dw, "android-7", common.StateReady)
+	if attached.LastSeen.IsZero() || attached.Model != "Pixel 6" {
+		t.Errorf("attached device without last seen time or model %+v", attached)
+	}
+
+	fake.SetHealth("android-7", common.DeviceHealth{BatteryLevel: 42, BatteryTemperature: 48})
+	dw.refreshDevices()
+	device, _ := dw.lookup("android-7")
+	if device.Health.BatteryLevel != 42 || device.Health.CollectedAt.IsZero() {
+		t.Errorf("health not refreshed %+v", device.Health)
+	}
+	if len(device.Health.Warnings) != 1 {
+		t.Errorf("hot battery not reported, warnings %v", device.Health.Warnings)
+	}
+	if !device.LastSeen.After(attached.LastSeen) {
+		t.Errorf("last seen not refreshed, %v then %v", attached.LastSeen, device.LastSeen)
+	}
+}
+
+func TestHealthWarnings(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		health common.DeviceHealth
+		want   int
+	}{
+		{"not collected", common.DeviceHealth{BatteryTemperature: 60}, 0},
+		{"healthy", common.DeviceHealth{BatteryLevel: 80, BatteryTemperature: 30, StorageFree: 8 << 30, StorageTotal: 64 << 30, CollectedAt: now}, 0},
+		{"hot battery", common.DeviceHealth{BatteryLevel: 80, BatteryTemperature: 47.5, CollectedAt: now}, 1},
+		{"low battery charging", common.DeviceHealth{BatteryLevel: 5, Charging: true, CollectedAt: now}, 0},
+		{"low battery", common.DeviceHealth{BatteryLevel: 5, CollectedAt: now}, 1},
+		{"full disk", common.DeviceHealth{BatteryLevel: 80, StorageFree: 200 << 20, StorageTotal: 32 << 30, CollectedAt: now}, 1},
+	}
+	for _, test := range tests {
+		if got := healthWarnings(test.health); len(got) != test.want {
+			t.Errorf("%s: got warnings %v, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDisconnectsDuringSessionsQuarantineDevice(t *testing.T) {
+	newSyncRecorder(t)
+	fake := provider.NewFake("android")
+	dw := startWatcher(t, fake)
+
+	fake.Attach(common.DeviceInfo{UDID: "android-8", Name: "Tab"})
+	waitForState(t, dw, "android-8", common.StateReady)
+	const disconnects = 5 // signals needed before quarantine
+	for i := 0; i < disconnects; i++ {
+		if err := dw.registry.Transition("android-8", common.StateInSession, "test"); err != nil {
+			t.Fatal(err)
+		}
+		fake.SetOnline("android-8", false)
+		waitForState(t, dw, "android-8", common.StateOffline)
+		fake.SetOnline("android-8", true)
+		if i < disconnects-1 {
+			waitForState(t, dw, "android-8", common.StateReady)
+		}
+	}
+
+	device := waitForState(t, dw, "android-8", common.StateQuarantined)
+	if device.HealthScore != 0 || device.Status != "connected" {
+		t.Errorf("unexpected quarantined device %+v", device)
+	}
+}
+
+func TestNetworkDeviceReconnectsWithBackoff(t *testing.T) {
+	networkTick, minReconnectBackoff = 10*time.Millisecond, 50*time.Millisecond
+	t.Cleanup(func() { networkTick, minReconnectBackoff = time.Second, 5*time.Second })
+	fake := provider.NewFake("android")
+	fake.FailConnect("10.0.0.21:5555", errors.New("connection refused"))
+	dw := startWatcher(t, fake)
+	if err := dw.AddNetworkDevice("10.0.0.21:5555; reboot"); err == nil {
+		t.Error("invalid address accepted")
+	}
+	if err := dw.AddNetworkDevice("10.0.0.21:5555"); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	// 50ms, 100ms then 200ms between the attempts
+	if attempts := countCalls(fake.Calls(), "connect 10.0.0.21:5555"); attempts < 2 || attempts > 3 {
+		t.Errorf("%d connection attempts in 200ms, want 2 or 3 with backoff", attempts)
+	}
+	fake.FailConnect("10.0.0.21:5555", nil)
+
+	device := waitForState(t, dw, "10.0.0.21:5555", common.StateReady)
+	if device.Transport != common.TransportNetwork {
+		t.Errorf("network device reported on transport %q", device.Transport)
+	}
+	attempts := countCalls(fake.Calls(), "connect 10.0.0.21:5555")
+	time.Sleep(100 * time.Millisecond)
+	if countCalls(fake.Calls(), "connect 10.0.0.21:5555") != attempts {
+		t.Error("connected device connected again")
+	}
+}